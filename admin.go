@@ -0,0 +1,237 @@
+package tinybastion
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/acuteaura/tinybastion/internal/logging"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// AdminServer lets operators inspect and evict peers. It listens separately from the tunnel API,
+// so it can be bound to a private port, and requires a static bearer token.
+type AdminServer struct {
+	listener *http.Server
+	tb       *Bastion
+	token    string
+	reload   ReloadFunc
+}
+
+// ReloadFunc reloads the settings of the running bastion and returns what changed
+type ReloadFunc func(ctx context.Context) ([]string, error)
+
+type EvictPeersResponse struct {
+	Evicted []string `json:"evicted"`
+}
+
+type ReloadResponse struct {
+	Changed []string `json:"changed"`
+	// Error explains why a reload was rejected, nothing was changed then
+	Error string `json:"error,omitempty"`
+}
+
+// NewAdminServer starts the admin API, reload may be nil if settings cannot be reloaded
+func NewAdminServer(ctx context.Context, tb *Bastion, listenPort int, token string, reload ReloadFunc) *AdminServer {
+	s := newAdminServer(tb, token, reload)
+
+	s.listener = &http.Server{
+		Addr:    fmt.Sprintf(":%d", listenPort),
+		Handler: s,
+		BaseContext: func(listener net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	go func() {
+		slog.Info("starting admin server", "port", listenPort)
+		err := s.listener.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("admin http server error", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	return s
+}
+
+func newAdminServer(tb *Bastion, token string, reload ReloadFunc) *AdminServer {
+	return &AdminServer{tb: tb, token: token, reload: reload}
+}
+
+func (s *AdminServer) Destroy() error {
+	return s.listener.Shutdown(context.Background())
+}
+
+// ServeHTTP handles
+//
+//	GET    /peers                   list all peers
+//	GET    /peers/<key>             inspect a peer
+//	DELETE /peers/<key>             evict a peer
+//	DELETE /peers?repository=<repo> evict all peers of a repository
+//	POST   /reload                  reload settings, like SIGHUP
+//
+// keys are base64 as usual, with the path percent-encoded where needed
+func (s *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveWithRequestID(w, r, s.route)
+}
+
+func (s *AdminServer) route(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !s.authorized(r) {
+		httpError(ctx, w, http.StatusUnauthorized, "bad admin token")
+		return
+	}
+
+	if r.URL.Path == "/reload" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			httpError(ctx, w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+			return
+		}
+		s.reloadSettings(w, r)
+		return
+	}
+
+	if r.URL.Path == "/peers" {
+		switch r.Method {
+		case http.MethodGet:
+			s.listPeers(w, r)
+		case http.MethodDelete:
+			s.evictRepository(w, r)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			httpError(ctx, w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+		}
+		return
+	}
+
+	keyStr := strings.TrimPrefix(r.URL.Path, "/peers/")
+	if keyStr == r.URL.Path {
+		httpError(ctx, w, http.StatusNotFound, fmt.Sprintf("no admin endpoint %s", r.URL.Path))
+		return
+	}
+	key, err := wgtypes.ParseKey(keyStr)
+	if err != nil {
+		httpError(ctx, w, http.StatusBadRequest, fmt.Sprintf("bad public key: %s", err))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.inspectPeer(ctx, w, key)
+	case http.MethodDelete:
+		s.evictPeer(ctx, w, key)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		httpError(ctx, w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *AdminServer) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *AdminServer) listPeers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	peers, err := s.tb.Peers()
+	if err != nil {
+		httpError(ctx, w, http.StatusInternalServerError, fmt.Sprintf("listing peers failed: %s", err))
+		return
+	}
+	writeJSON(ctx, w, peers)
+}
+
+func (s *AdminServer) inspectPeer(ctx context.Context, w http.ResponseWriter, key wgtypes.Key) {
+	peer, err := s.tb.Peer(key)
+	if errors.Is(err, ErrPeerNotFound) {
+		httpError(ctx, w, http.StatusNotFound, fmt.Sprintf("no peer %s", key))
+		return
+	}
+	if err != nil {
+		httpError(ctx, w, http.StatusInternalServerError, fmt.Sprintf("inspecting peer failed: %s", err))
+		return
+	}
+	writeJSON(ctx, w, peer)
+}
+
+func (s *AdminServer) evictPeer(ctx context.Context, w http.ResponseWriter, key wgtypes.Key) {
+	err := s.tb.RemovePeer(ctx, key)
+	if errors.Is(err, ErrPeerNotFound) {
+		httpError(ctx, w, http.StatusNotFound, fmt.Sprintf("no peer %s", key))
+		return
+	}
+	if err != nil {
+		httpError(ctx, w, http.StatusInternalServerError, fmt.Sprintf("evicting peer failed: %s", err))
+		return
+	}
+	logging.FromContext(ctx).Info("admin evicted peer", "peer", key.String())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) evictRepository(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	repository := r.URL.Query().Get("repository")
+	if repository == "" {
+		httpError(ctx, w, http.StatusBadRequest, "evicting all peers requires a repository")
+		return
+	}
+
+	keys, err := s.tb.RemovePeersByClaim(ctx, "repository", repository)
+	if err != nil {
+		httpError(ctx, w, http.StatusInternalServerError, fmt.Sprintf("evicting peers failed: %s", err))
+		return
+	}
+
+	res := EvictPeersResponse{Evicted: make([]string, 0, len(keys))}
+	for _, key := range keys {
+		res.Evicted = append(res.Evicted, key.String())
+	}
+	logging.FromContext(ctx).Info("admin evicted peers of repository", "repository", repository, "count", len(keys))
+	writeJSON(ctx, w, res)
+}
+
+func (s *AdminServer) reloadSettings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if s.reload == nil {
+		httpError(ctx, w, http.StatusNotFound, "reloading is not supported")
+		return
+	}
+
+	changed, err := s.reload(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Warn("reload rejected", "error", err)
+		data, _ := json.Marshal(ReloadResponse{Changed: []string{}, Error: err.Error()})
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write(data)
+		return
+	}
+	writeJSON(ctx, w, ReloadResponse{Changed: changed})
+}
+
+func writeJSON(ctx context.Context, w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		httpError(ctx, w, http.StatusInternalServerError, "cannot marshall response json")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
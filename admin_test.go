@@ -0,0 +1,134 @@
+package tinybastion
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func doAdminRequest(s *AdminServer, method string, target string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+func peerPath(key wgtypes.Key) string {
+	return "/peers/" + url.PathEscape(key.String())
+}
+
+func TestAdminServer(t *testing.T) {
+	b, device := newTestBastion(t, "10.0.0.0/29")
+	s := newAdminServer(b, "secret", nil)
+
+	keys := make([]wgtypes.Key, 0, 3)
+	for _, repository := range []string{"acuteaura/tinybastion", "acuteaura/tinybastion", "acuteaura/other"} {
+		key := generateKey(t)
+		_, err := b.AddPeer(context.Background(), key, PeerOptions{
+			Owner:  testIdentity,
+			Claims: map[string]interface{}{"repository": repository},
+			Expiry: time.Now().Add(time.Hour),
+		})
+		require.NoError(t, err)
+		keys = append(keys, key)
+	}
+	require.NoError(t, device.SetLastHandshake(keys[0], time.Now()))
+
+	rec := doAdminRequest(s, http.MethodGet, "/peers", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = doAdminRequest(s, http.MethodGet, "/peers", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	// the token alone, without the Bearer scheme, isn't enough
+	req := httptest.NewRequest(http.MethodGet, "/peers", nil)
+	req.Header.Set("Authorization", "secret")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = doAdminRequest(s, http.MethodGet, "/peers", "secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var peers []PeerInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &peers))
+	assert.Len(t, peers, 3)
+
+	rec = doAdminRequest(s, http.MethodGet, peerPath(keys[0]), "secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var peer PeerInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &peer))
+	assert.Equal(t, keys[0].String(), peer.PublicKey)
+	assert.Equal(t, []string{"10.0.0.2"}, peer.IPs)
+	assert.Equal(t, testIdentity, peer.Owner)
+	assert.Equal(t, "acuteaura/tinybastion", peer.Claims["repository"])
+	assert.False(t, peer.LastHandshake.IsZero())
+	assert.False(t, peer.Expires.IsZero())
+
+	rec = doAdminRequest(s, http.MethodDelete, peerPath(keys[2]), "secret")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	rec = doAdminRequest(s, http.MethodGet, peerPath(keys[2]), "secret")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = doAdminRequest(s, http.MethodDelete, "/peers?repository="+url.QueryEscape("acuteaura/tinybastion"), "secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var evicted EvictPeersResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &evicted))
+	assert.ElementsMatch(t, []string{keys[0].String(), keys[1].String()}, evicted.Evicted)
+	assert.Empty(t, devicePeers(t, device))
+
+	rec = doAdminRequest(s, http.MethodDelete, "/peers", "secret")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doAdminRequest(s, http.MethodGet, "/peers/notakey", "secret")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doAdminRequest(s, http.MethodGet, "/other", "secret")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestAdminServer_NoToken(t *testing.T) {
+	b, _ := newTestBastion(t, "10.0.0.0/29")
+	s := newAdminServer(b, "", nil)
+
+	rec := doAdminRequest(s, http.MethodGet, "/peers", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestAdminServer_Reload(t *testing.T) {
+	b, _ := newTestBastion(t, "10.0.0.0/29")
+
+	reloadErr := errors.New("changing wg-port requires a restart")
+	s := newAdminServer(b, "secret", func(ctx context.Context) ([]string, error) {
+		if reloadErr != nil {
+			return nil, reloadErr
+		}
+		return []string{"policy"}, nil
+	})
+
+	rec := doAdminRequest(s, http.MethodPost, "/reload", "secret")
+	require.Equal(t, http.StatusConflict, rec.Code)
+	var res ReloadResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, reloadErr.Error(), res.Error)
+
+	reloadErr = nil
+	rec = doAdminRequest(s, http.MethodPost, "/reload", "secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	res = ReloadResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, []string{"policy"}, res.Changed)
+
+	rec = doAdminRequest(s, http.MethodGet, "/reload", "secret")
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	rec = doAdminRequest(newAdminServer(b, "secret", nil), http.MethodPost, "/reload", "secret")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,47 @@
+package tinybastion
+
+import (
+	"context"
+
+	"github.com/acuteaura/tinybastion/internal/audit"
+	"github.com/acuteaura/tinybastion/internal/logging"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// auditEntry describes a peer for the audit log, reason is only set for audit.EventEnd
+func (p *peer) auditEntry(ctx context.Context, event string, key wgtypes.Key, reason string) audit.Entry {
+	e := identityAuditEntry(ctx, event, p.owner, p.claims)
+	e.PublicKey = key.String()
+	e.IPs = p.addresses()
+	e.Reason = reason
+	if !p.expires.IsZero() {
+		expires := p.expires
+		e.Expires = &expires
+	}
+	return e
+}
+
+// identityAuditEntry records who a request was made by, with the claims identifying the job
+func identityAuditEntry(ctx context.Context, event string, owner Identity, claims map[string]interface{}) audit.Entry {
+	return audit.Entry{
+		Time:       clock.Now(),
+		Event:      event,
+		RequestID:  logging.RequestID(ctx),
+		Subject:    owner.Subject,
+		Issuer:     owner.Issuer,
+		Repository: claimString(claims, "repository"),
+		Workflow:   claimString(claims, "workflow"),
+		RunID:      claimString(claims, "run_id"),
+		Actor:      claimString(claims, "actor"),
+	}
+}
+
+// AuditDenied records a verified token the policy did not grant a tunnel to
+func (b *Bastion) AuditDenied(ctx context.Context, owner Identity, claims map[string]interface{}) {
+	e := identityAuditEntry(ctx, audit.EventDenied, owner, claims)
+	e.Reason = "policy"
+	err := b.audit.Append(e)
+	if err != nil {
+		logging.FromContext(ctx).Error("unable to audit denied request", "error", err)
+	}
+}
@@ -0,0 +1,117 @@
+package tinybastion
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/acuteaura/tinybastion/internal/audit"
+	"github.com/acuteaura/tinybastion/internal/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBastion_AuditLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	b, _ := newTestBastion(t, "10.0.0.0/29")
+	auditLog, err := audit.Open(filename)
+	require.NoError(t, err)
+	b.audit = auditLog
+
+	ctx := logging.WithRequestID(context.Background(), "request-1")
+	key := generateKey(t)
+	claims := map[string]interface{}{"repository": "acuteaura/app", "workflow": "deploy", "run_id": "42", "actor": "someone"}
+	_, err = b.AddPeer(ctx, key, PeerOptions{Owner: testIdentity, Claims: claims, Expiry: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	_, err = b.RenewPeer(ctx, key, testIdentity, time.Now().Add(2*time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, b.RemoveOwnedPeer(ctx, key, testIdentity))
+	b.AuditDenied(ctx, testIdentity, claims)
+	require.NoError(t, auditLog.Close())
+
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+	n, _, err := audit.Verify(f)
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, n)
+
+	_, err = f.Seek(0, 0)
+	require.NoError(t, err)
+	entries := make([]audit.Entry, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e audit.Entry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		entries = append(entries, e)
+	}
+
+	grant := entries[0]
+	assert.Equal(t, audit.EventGrant, grant.Event)
+	assert.Equal(t, "request-1", grant.RequestID)
+	assert.Equal(t, key.String(), grant.PublicKey)
+	assert.Equal(t, []string{"10.0.0.2"}, grant.IPs)
+	assert.Equal(t, testIdentity.Subject, grant.Subject)
+	assert.Equal(t, "acuteaura/app", grant.Repository)
+	assert.Equal(t, "deploy", grant.Workflow)
+	assert.Equal(t, "42", grant.RunID)
+	assert.Equal(t, "someone", grant.Actor)
+	require.NotNil(t, grant.Expires)
+
+	assert.Equal(t, audit.EventRenew, entries[1].Event)
+	assert.True(t, entries[1].Expires.After(*grant.Expires))
+
+	assert.Equal(t, audit.EventEnd, entries[2].Event)
+	assert.Equal(t, removedDeleted, entries[2].Reason)
+	assert.Equal(t, []string{"10.0.0.2"}, entries[2].IPs)
+
+	assert.Equal(t, audit.EventDenied, entries[3].Event)
+	assert.Empty(t, entries[3].PublicKey)
+
+	// numeric claims are decoded as float64, but must not end up as 1.23456789e+09
+	e := identityAuditEntry(ctx, audit.EventGrant, testIdentity, map[string]interface{}{"run_id": float64(1234567890)})
+	assert.Equal(t, "1234567890", e.RunID)
+}
+
+func TestBastion_RotateUnaudited(t *testing.T) {
+	b, device := newTestBastion(t, "10.0.0.0/29")
+	key := generateKey(t)
+	created, err := b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity})
+	require.NoError(t, err)
+
+	// a closed log fails every append
+	auditLog, err := audit.Open(filepath.Join(t.TempDir(), "audit.jsonl"))
+	require.NoError(t, err)
+	require.NoError(t, auditLog.Close())
+	b.audit = auditLog
+
+	_, err = b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity, RotatePSK: true})
+	assert.Error(t, err)
+	// the client keeps the PSK it has, so the tunnel keeps working
+	assert.Equal(t, *created.PresharedKey, devicePeers(t, device)[key].PresharedKey)
+	assert.Equal(t, *created.PresharedKey, b.peers[key].psk)
+}
+
+func TestBastion_RenewUnaudited(t *testing.T) {
+	b, _ := newTestBastion(t, "10.0.0.0/29")
+	key := generateKey(t)
+	expires := time.Now().Add(time.Hour)
+	_, err := b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity, Expiry: expires})
+	require.NoError(t, err)
+
+	auditLog, err := audit.Open(filepath.Join(t.TempDir(), "audit.jsonl"))
+	require.NoError(t, err)
+	require.NoError(t, auditLog.Close())
+	b.audit = auditLog
+
+	_, err = b.RenewPeer(context.Background(), key, testIdentity, expires.Add(time.Hour))
+	assert.Error(t, err)
+	current, err := b.PeerExpiry(key)
+	require.NoError(t, err)
+	assert.True(t, expires.Equal(current), "the peer still expires with its first token")
+}
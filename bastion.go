@@ -1,53 +1,138 @@
 package tinybastion
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"net"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/acuteaura/tinybastion/internal/audit"
+	"github.com/acuteaura/tinybastion/internal/logging"
+	"github.com/acuteaura/tinybastion/internal/nft"
+	"github.com/acuteaura/tinybastion/internal/policy"
 	"github.com/acuteaura/tinybastion/internal/stabilizer"
+	"github.com/acuteaura/tinybastion/internal/webhook"
 	"github.com/jonboulle/clockwork"
 	"github.com/metal-stack/go-ipam"
 	"github.com/pkg/errors"
-	"github.com/vishvananda/netlink"
-	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 var clock = clockwork.NewRealClock()
 
+var (
+	ErrPeerNotFound      = errors.New("peer not found")
+	ErrPeerOwnerMismatch = errors.New("peer belongs to a different identity")
+	ErrPeerExpired       = errors.New("peer has expired")
+	ErrUnknownPool       = errors.New("unknown address pool")
+	ErrRunPeerLimit      = errors.New("run has too many peers")
+)
+
+// Firewall programs forwarding and NAT rules for the tunnel, see nft.Table
+type Firewall interface {
+	Apply(ruleset *nft.Ruleset) error
+	Destroy() error
+}
+
 type Bastion struct {
 	Config *Config
-	Client *wgctrl.Client
-
-	gatewayIP             *ipam.IP
+	Device DeviceManager
+	// Firewall is nil if there is nothing to filter or NAT
+	Firewall Firewall
+
+	// prefixes are the configured tunnel networks, at most one IPv4 and one IPv6
+	prefixes []*net.IPNet
+	// pools are the networks of Config.Pools by name
+	pools                 map[string][]*net.IPNet
+	routedNetworks        []*net.IPNet
+	gatewayIPs            []*ipam.IP
 	ipam                  ipam.Ipamer
 	peerCleanupStabilizer *stabilizer.IterativeStabilizer[wgtypes.Key]
-	link                  netlink.Link
 	publicKey             wgtypes.Key
+
+	// peers tracks everything we handed out, so it can be given back when a peer goes away
+	peers   map[wgtypes.Key]*peer
+	peersMu sync.Mutex
+
+	// audit is nil without Config.AuditLogFile, which discards all entries
+	audit *audit.Log
+	// webhooks is nil without Config.WebhookURLs, which discards all events
+	webhooks *webhook.Notifier
+}
+
+type peer struct {
+	// one address per prefix of its pool
+	ips   []*ipam.IP
+	pool  string
+	psk   wgtypes.Key
+	owner Identity
+	// claims of the token the peer was created with, for operators
+	claims  map[string]interface{}
+	grants  []policy.Grant
+	group   string
+	created time.Time
+	// expires is when the reaper removes the peer, zero if never
+	expires time.Time
+	// handshaked and stale track what webhooks were sent already
+	handshaked bool
+	stale      bool
+}
+
+// PeerOptions carries what authorization decided about a new peer
+type PeerOptions struct {
+	Owner Identity
+	// Claims of the token the peer is requested with, kept for the admin API
+	Claims map[string]interface{}
+	// Grants limit which routed networks the peer may reach, nil allows all of them
+	Grants []policy.Grant
+	// PeerGroup members can reach each other with peer isolation enabled
+	PeerGroup string
+	// Expiry is usually the expiry of the token the peer was requested with, zero if it has none.
+	// Config.MaxSessionDuration may shorten it.
+	Expiry time.Time
+	// RotatePSK replaces the PSK if the peer already exists, otherwise the existing config is returned as is
+	RotatePSK bool
+	// Pool names the Config.Pools entry to take addresses from, the tunnel networks if empty
+	Pool string
 }
 
 type BastionServerInfo struct {
-	EndpointHost string
-	EndpointPort int
-	GatewayIP    string
-	PublicKey    string
+	EndpointHost   string
+	EndpointPort   int
+	GatewayIPs     []string
+	PublicKey      string
+	RoutedNetworks []string
 }
 
+// New creates a bastion on a wireguard interface of the configured backend, with nftables rules if needed
 func New(c Config) (*Bastion, error) {
-	stab := stabilizer.NewIterative[wgtypes.Key](3)
-	ipamer := ipam.New()
-	_, err := ipamer.NewPrefix(c.CIDR)
+	err := c.Validate()
 	if err != nil {
 		return nil, err
 	}
 
-	client, err := wgctrl.New()
+	device, err := c.device()
 	if err != nil {
 		return nil, err
 	}
 
-	bastion := &Bastion{Config: &c, Client: client, peerCleanupStabilizer: stab, ipam: ipamer}
+	var firewall Firewall
+	if len(c.RoutedNetworks) > 0 || !c.DisablePeerIsolation {
+		firewall = nft.NewTable(c.DeviceName)
+	}
+
+	return NewWithDevice(c, device, firewall)
+}
+
+// NewWithDevice creates a bastion on the given device, firewall may be nil if neither
+// routed networks nor peer isolation are needed
+func NewWithDevice(c Config, device DeviceManager, firewall Firewall) (*Bastion, error) {
+	bastion, err := newBastion(c, device, firewall)
+	if err != nil {
+		return nil, err
+	}
 	err = bastion.init()
 	if err != nil {
 		return nil, err
@@ -55,197 +140,767 @@ func New(c Config) (*Bastion, error) {
 	return bastion, nil
 }
 
+// newBastion sets up the bookkeeping for a bastion without touching the device
+func newBastion(c Config, device DeviceManager, firewall Firewall) (*Bastion, error) {
+	prefixes, err := c.prefixes()
+	if err != nil {
+		return nil, err
+	}
+	pools, err := c.pools()
+	if err != nil {
+		return nil, err
+	}
+	routedNetworks, err := c.routedNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	stab := stabilizer.NewIterative[wgtypes.Key](3)
+	ipamer := ipam.New()
+	for _, prefix := range allPrefixes(prefixes, pools) {
+		_, err := ipamer.NewPrefix(prefix.String())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var auditLog *audit.Log
+	if c.AuditLogFile != "" {
+		auditLog, err = audit.Open(c.AuditLogFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Bastion{
+		Config:                &c,
+		Device:                device,
+		Firewall:              firewall,
+		peerCleanupStabilizer: stab,
+		prefixes:              prefixes,
+		pools:                 pools,
+		routedNetworks:        routedNetworks,
+		ipam:                  ipamer,
+		peers:                 make(map[wgtypes.Key]*peer),
+		audit:                 auditLog,
+		webhooks:              newNotifier(c.WebhookURLs, c.WebhookSecret),
+	}, nil
+}
+
 func (b *Bastion) init() error {
-	// check if we need to re-create the interface
-	// do not attempt to reuse an interface, since we'd have to reset WG state AND addrs
-	link, err := netlink.LinkByName(b.Config.DeviceName)
+	err := b.Device.Create()
 	if err != nil {
-		_, ok := err.(netlink.LinkNotFoundError)
-		if !ok {
+		return err
+	}
+
+	for _, prefix := range b.prefixes {
+		// allocate the first IP of the network block
+		ip, err := b.ipam.AcquireIP(prefix.String())
+		if err != nil {
 			return err
 		}
-	} else {
-		log.Default().Printf("link %s found, re-creating", b.Config.DeviceName)
-		err = netlink.LinkDel(link)
+
+		// add the IP as a host address (/32 or /128), since we don't want subnet routing
+		// this will however require setting up a route for the prefix
+		err = b.Device.AddAddress(hostNet(ip))
 		if err != nil {
-			return errors.Wrap(err, "unable to delete link")
+			return err
 		}
-	}
 
-	// LinkAttr is used to describe the interface
-	// we just need to set a name
-	wgLinkAttr := netlink.NewLinkAttrs()
-	wgLinkAttr.Name = b.Config.DeviceName
+		// create a route to dump all non-local traffic for the prefix into the interface
+		// we have no implicit routing since we use a host address on the interface
+		err = b.Device.AddRoute(prefix)
+		if err != nil {
+			return err
+		}
 
-	wgLink := &wg{
-		LinkAttrs: wgLinkAttr,
+		b.gatewayIPs = append(b.gatewayIPs, ip)
 	}
 
-	// add the interface
-	err = netlink.LinkAdd(wgLink)
-	if err != nil {
-		return errors.Wrap(err, "unable to create link")
+	// pools are reached through the gateway addresses of the tunnel networks
+	for _, name := range poolNames(b.pools) {
+		for _, prefix := range b.pools[name] {
+			err = b.Device.AddRoute(prefix)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	// re-aquire the link to get the index, LinkAdd does not write info back!
-	b.link, err = netlink.LinkByName(b.Config.DeviceName)
+	if len(b.routedNetworks) > 0 {
+		err = b.Device.EnableForwarding(b.allPrefixes())
+		if err != nil {
+			return errors.Wrap(err, "unable to enable forwarding")
+		}
+	}
+
+	privkey, err := b.loadPrivateKey()
 	if err != nil {
 		return err
 	}
+	b.publicKey = privkey.PublicKey()
+
+	port := b.Config.Port
 
-	// allocate the first IP of the network block
-	ip, err := b.ipam.AcquireIP(b.Config.CIDR)
+	err = b.Device.Configure(wgtypes.Config{
+		PrivateKey: &privkey,
+		ListenPort: &port,
+
+		// make sure we start from a clean slate
+		ReplacePeers: true,
+	})
 	if err != nil {
 		return err
 	}
 
-	// add the IP + /32, since we don't want subnet routing
-	// this will however require setting up a route for the CIDR
-	err = netlink.AddrAdd(wgLink, &netlink.Addr{IPNet: &net.IPNet{
-		IP:   ip.IP.IPAddr().IP,
-		Mask: net.IPv4Mask(255, 255, 255, 255),
-	}})
+	err = b.restorePeers()
 	if err != nil {
 		return err
 	}
 
-	// WG interfaces always show UNKNOWN, but need to be set up anyway to accept routes
-	err = netlink.LinkSetUp(b.link)
+	// the table is replaced as a whole, which also cleans up anything a previous instance left behind
+	b.peersMu.Lock()
+	defer b.peersMu.Unlock()
+	return b.applyFirewall()
+}
+
+// loadPrivateKey reads the bastion key from Config.PrivateKeyFile, creating the file if needed.
+// Without a key file, an ephemeral key is generated.
+func (b *Bastion) loadPrivateKey() (wgtypes.Key, error) {
+	if b.Config.PrivateKeyFile == "" {
+		return wgtypes.GeneratePrivateKey()
+	}
+	return loadOrCreatePrivateKey(b.Config.PrivateKeyFile)
+}
+
+// AddPeer issues an address and PSK to a peer. Adding a peer that already exists for the same owner
+// returns its current config, so retried requests don't leak addresses. A different owner gets ErrPeerOwnerMismatch.
+func (b *Bastion) AddPeer(ctx context.Context, key wgtypes.Key, opts PeerOptions) (*wgtypes.PeerConfig, error) {
+	psk, err := wgtypes.GenerateKey()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	b.peersMu.Lock()
+	defer b.peersMu.Unlock()
+
+	if existing, ok := b.peers[key]; ok {
+		if existing.owner != opts.Owner {
+			return nil, ErrPeerOwnerMismatch
+		}
+		if existing.expires.IsZero() || clock.Now().Before(existing.expires) {
+			return b.reissuePeer(ctx, key, existing, opts.RotatePSK, psk)
+		}
+		// the reaper just hasn't come around yet, start over with a fresh peer
+		err = b.removePeers(ctx, []wgtypes.Key{key}, removedExpired)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	run := runOf(opts.Claims)
+	if b.Config.MaxPeersPerRun > 0 && run != "" && b.runPeers(opts.Owner.Issuer, run) >= b.Config.MaxPeersPerRun {
+		return nil, ErrRunPeerLimit
 	}
 
-	// create a route to dump all non-local traffic for the CIDR into the interface
-	// we have no implicit routing since we use a /32 on the interface
-	_, ipnet, err := net.ParseCIDR(b.Config.CIDR)
+	prefixes, err := b.poolPrefixes(opts.Pool)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	route := &netlink.Route{
-		Dst:       ipnet,
-		LinkIndex: b.link.Attrs().Index,
+	ips := make([]*ipam.IP, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		ip, err := b.ipam.AcquireIP(prefix.String())
+		if err != nil {
+			b.releaseIPs(ips)
+			return nil, err
+		}
+		ips = append(ips, ip)
 	}
-	err = netlink.RouteAdd(route)
+
+	p := &peer{ips: ips, pool: opts.Pool, psk: psk, owner: opts.Owner, claims: opts.Claims, grants: opts.Grants, group: opts.PeerGroup, created: clock.Now()}
+	p.expires = b.expiry(p, opts.Expiry)
+	newPeer := b.peerConfig(key, p)
+
+	err = b.Device.Configure(wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{newPeer},
+	})
+
 	if err != nil {
-		return err
+		b.releaseIPs(ips)
+		return nil, err
 	}
 
-	b.gatewayIP = ip
+	b.peers[key] = p
 
-	// ensure the interface is considered valid by wireguard
-	_, err = b.Client.Device(b.Config.DeviceName)
+	err = b.applyFirewall()
 	if err != nil {
-		return err
+		// without its rules the peer is useless, so don't leave it half set up
+		rmErr := b.removePeers(ctx, []wgtypes.Key{key}, removedRollback)
+		if rmErr != nil {
+			logging.FromContext(ctx).Error("unable to roll back peer", "peer", key.String(), "error", rmErr)
+		}
+		return nil, err
 	}
 
-	// generate ephemeral bastion keys
-	privkey, err := wgtypes.GeneratePrivateKey()
+	err = b.audit.Append(p.auditEntry(ctx, audit.EventGrant, key, ""))
 	if err != nil {
-		return err
+		// an unaudited tunnel must not be handed out
+		rmErr := b.removePeers(ctx, []wgtypes.Key{key}, removedRollback)
+		if rmErr != nil {
+			logging.FromContext(ctx).Error("unable to roll back peer", "peer", key.String(), "error", rmErr)
+		}
+		return nil, err
 	}
-	b.publicKey = privkey.PublicKey()
 
-	port := b.Config.Port
+	b.saveState()
+	b.webhooks.Notify(p.webhookEvent(webhook.EventPeerCreated, key, ""))
 
-	err = b.Client.ConfigureDevice(b.Config.DeviceName, wgtypes.Config{
-		PrivateKey: &privkey,
-		ListenPort: &port,
+	logging.FromContext(ctx).Info("added peer", "peer", key.String(), "ips", p.addresses(), "pool", p.pool, "owner", opts.Owner.String(), "expires", formatExpiry(p.expires))
 
-		// make sure we start from a clean slate
-		ReplacePeers: true,
+	return &newPeer, nil
+}
+
+// reissuePeer returns the config of an existing peer, optionally with a new PSK. It must be called with peersMu held.
+func (b *Bastion) reissuePeer(ctx context.Context, key wgtypes.Key, p *peer, rotatePSK bool, psk wgtypes.Key) (*wgtypes.PeerConfig, error) {
+	if !rotatePSK {
+		pc := b.peerConfig(key, p)
+		logging.FromContext(ctx).Info("peer already exists, returning it unchanged", "peer", key.String(), "owner", p.owner.String())
+		return &pc, nil
+	}
+
+	rotated := *p
+	rotated.psk = psk
+	pc := b.peerConfig(key, &rotated)
+	pc.UpdateOnly = true
+	err := b.Device.Configure(wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{pc},
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
-}
-
-func (b *Bastion) AddPeer(key wgtypes.Key) (*wgtypes.PeerConfig, error) {
-	psk, err := wgtypes.GenerateKey()
+	err = b.audit.Append(rotated.auditEntry(ctx, audit.EventRotate, key, ""))
 	if err != nil {
+		// an unaudited PSK must not be handed out, and the client still has the old one
+		restored := b.peerConfig(key, p)
+		restored.UpdateOnly = true
+		rbErr := b.Device.Configure(wgtypes.Config{
+			Peers: []wgtypes.PeerConfig{restored},
+		})
+		if rbErr != nil {
+			logging.FromContext(ctx).Error("unable to restore psk of peer", "peer", key.String(), "error", rbErr)
+		}
 		return nil, err
 	}
+	p.psk = psk
+	b.saveState()
+
+	logging.FromContext(ctx).Info("rotated psk of peer", "peer", key.String(), "owner", p.owner.String())
+	pc.UpdateOnly = false
+	return &pc, nil
+}
 
+// runPeers counts the peers of a run of an issuer, it must be called with peersMu held
+func (b *Bastion) runPeers(issuer string, run string) int {
+	count := 0
+	for _, p := range b.peers {
+		if p.owner.Issuer == issuer && runOf(p.claims) == run {
+			count++
+		}
+	}
+	return count
+}
+
+// expiry caps the requested expiry at Config.MaxSessionDuration from the creation of the peer
+func (b *Bastion) expiry(p *peer, requested time.Time) time.Time {
+	if b.Config.MaxSessionDuration <= 0 {
+		return requested
+	}
+	max := p.created.Add(b.Config.MaxSessionDuration)
+	if requested.IsZero() || requested.After(max) {
+		return max
+	}
+	return requested
+}
+
+func formatExpiry(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (b *Bastion) peerConfig(key wgtypes.Key, p *peer) wgtypes.PeerConfig {
 	// time interval of no activity for which wireguard forces a keepalive packet
 	// usually used for NAT, but we use it too check if the peer is still there
 	persistentKeepalive := time.Duration(b.Config.PersistentKeepalive) * time.Second
+	psk := p.psk
 
-	ip, err := b.ipam.AcquireIP(b.Config.CIDR)
-	if err != nil {
-		return nil, err
+	// we do not need subnet routing, so we use host addresses
+	// this does however require us to set up explicit routes
+	allowedIPs := make([]net.IPNet, 0, len(p.ips))
+	for _, ip := range p.ips {
+		allowedIPs = append(allowedIPs, hostNet(ip))
 	}
 
-	newPeer := wgtypes.PeerConfig{
+	return wgtypes.PeerConfig{
 		PublicKey:                   key,
 		PresharedKey:                &psk,
 		Endpoint:                    nil,
 		PersistentKeepaliveInterval: &persistentKeepalive,
 		ReplaceAllowedIPs:           true,
+		AllowedIPs:                  allowedIPs,
+	}
+}
 
-		// we do not need subnet routing, so we use a /32 mask
-		// this does however require us to set up explicit routes
-		AllowedIPs: []net.IPNet{
-			{IP: ip.IP.IPAddr().IP, Mask: net.IPv4Mask(255, 255, 255, 255)},
-		},
+func (b *Bastion) CleanupPeers() error {
+	device, err := b.Device.Device()
+	if err != nil {
+		return err
 	}
 
-	err = b.Client.ConfigureDevice(b.Config.DeviceName, wgtypes.Config{
-		Peers: []wgtypes.PeerConfig{newPeer},
-	})
+	badPeers := make(map[wgtypes.Key]struct{})
+	for _, peer := range device.Peers {
+		cutoffTimestamp := clock.Now().Add(peer.PersistentKeepaliveInterval * -1)
+		if peer.LastHandshakeTime.IsZero() || peer.LastHandshakeTime.Before(cutoffTimestamp) {
+			badPeers[peer.PublicKey] = struct{}{}
+		}
+	}
 
+	slog.Debug("found candidates for deletion", "count", len(badPeers))
+
+	cleanupRuns.Inc()
+	peersToRemove := b.peerCleanupStabilizer.Iterate(badPeers)
+
+	if len(peersToRemove) > 0 {
+		slog.Info("removing stale peers", "peers", keyStrings(peersToRemove))
+	}
+
+	b.peersMu.Lock()
+	defer b.peersMu.Unlock()
+
+	b.notifyHandshakes(device.Peers, badPeers)
+	return b.removePeers(context.Background(), peersToRemove, removedStale)
+}
+
+// ReapExpiredPeers removes all peers past their expiry, whether they are still handshaking or not
+func (b *Bastion) ReapExpiredPeers() error {
+	b.peersMu.Lock()
+	defer b.peersMu.Unlock()
+
+	now := clock.Now()
+	expired := make([]wgtypes.Key, 0)
+	for key, p := range b.peers {
+		if !p.expires.IsZero() && !now.Before(p.expires) {
+			expired = append(expired, key)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	slog.Info("reaping expired peers", "peers", keyStrings(expired))
+
+	return b.removePeers(context.Background(), expired, removedExpired)
+}
+
+// RenewPeer extends the expiry of a peer issued to the given identity, its address and PSK stay the same.
+// The new expiry is still capped by Config.MaxSessionDuration and returned.
+func (b *Bastion) RenewPeer(ctx context.Context, key wgtypes.Key, owner Identity, expiry time.Time) (time.Time, error) {
+	b.peersMu.Lock()
+	defer b.peersMu.Unlock()
+
+	p, ok := b.peers[key]
+	if !ok {
+		return time.Time{}, ErrPeerNotFound
+	}
+	if p.owner != owner {
+		return time.Time{}, ErrPeerOwnerMismatch
+	}
+	if !p.expires.IsZero() && !clock.Now().Before(p.expires) {
+		// the reaper just hasn't come around yet
+		return time.Time{}, ErrPeerExpired
+	}
+
+	// like grants, a renewal only takes effect once it is audited
+	renewed := *p
+	renewed.expires = b.expiry(p, expiry)
+	err := b.audit.Append(renewed.auditEntry(ctx, audit.EventRenew, key, ""))
+	if err != nil {
+		return time.Time{}, err
+	}
+	p.expires = renewed.expires
+	b.saveState()
+
+	logging.FromContext(ctx).Info("renewed peer", "peer", key.String(), "owner", owner.String(), "expires", formatExpiry(p.expires))
+	return p.expires, nil
+}
+
+// PeerExpiry returns when a peer expires, zero if never
+func (b *Bastion) PeerExpiry(key wgtypes.Key) (time.Time, error) {
+	b.peersMu.Lock()
+	defer b.peersMu.Unlock()
+
+	p, ok := b.peers[key]
+	if !ok {
+		return time.Time{}, ErrPeerNotFound
+	}
+	return p.expires, nil
+}
+
+// PeerInfo describes an issued peer for operators
+type PeerInfo struct {
+	PublicKey     string                 `json:"public_key"`
+	IPs           []string               `json:"ips"`
+	Pool          string                 `json:"pool,omitempty"`
+	Owner         Identity               `json:"owner"`
+	Claims        map[string]interface{} `json:"claims,omitempty"`
+	Grants        []policy.Grant         `json:"grants,omitempty"`
+	PeerGroup     string                 `json:"peer_group,omitempty"`
+	Created       time.Time              `json:"created"`
+	Expires       time.Time              `json:"expires"`
+	LastHandshake time.Time              `json:"last_handshake"`
+	ReceiveBytes  int64                  `json:"receive_bytes"`
+	TransmitBytes int64                  `json:"transmit_bytes"`
+}
+
+// Peers lists all issued peers along with their state on the device
+func (b *Bastion) Peers() ([]PeerInfo, error) {
+	device, err := b.Device.Device()
 	if err != nil {
 		return nil, err
 	}
+	devicePeers := make(map[wgtypes.Key]wgtypes.Peer, len(device.Peers))
+	for _, dp := range device.Peers {
+		devicePeers[dp.PublicKey] = dp
+	}
 
-	log.Default().Printf("added new peer %s@%s", newPeer.PublicKey.PublicKey(), newPeer.AllowedIPs[0].String())
+	b.peersMu.Lock()
+	defer b.peersMu.Unlock()
 
-	return &newPeer, nil
+	infos := make([]PeerInfo, 0, len(b.peers))
+	for key, p := range b.peers {
+		infos = append(infos, p.info(key, devicePeers[key]))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Created.Before(infos[j].Created)
+	})
+	return infos, nil
 }
 
-func (b *Bastion) CleanupPeers() error {
-	device, err := b.Client.Device(b.Config.DeviceName)
+// Peer describes a single issued peer
+func (b *Bastion) Peer(key wgtypes.Key) (PeerInfo, error) {
+	device, err := b.Device.Device()
 	if err != nil {
-		return err
+		return PeerInfo{}, err
 	}
 
-	badPeers := make(map[wgtypes.Key]struct{})
-	for _, peer := range device.Peers {
-		cutoffTimestamp := clock.Now().Add(peer.PersistentKeepaliveInterval * -1)
-		if peer.LastHandshakeTime.IsZero() || peer.LastHandshakeTime.Before(cutoffTimestamp) {
-			badPeers[peer.PublicKey] = struct{}{}
+	b.peersMu.Lock()
+	defer b.peersMu.Unlock()
+
+	p, ok := b.peers[key]
+	if !ok {
+		return PeerInfo{}, ErrPeerNotFound
+	}
+	for _, dp := range device.Peers {
+		if dp.PublicKey == key {
+			return p.info(key, dp), nil
 		}
 	}
+	return p.info(key, wgtypes.Peer{}), nil
+}
+
+func (p *peer) info(key wgtypes.Key, dp wgtypes.Peer) PeerInfo {
+	ips := make([]string, 0, len(p.ips))
+	for _, ip := range p.ips {
+		ips = append(ips, ip.IP.String())
+	}
+	return PeerInfo{
+		PublicKey:     key.String(),
+		IPs:           ips,
+		Pool:          p.pool,
+		Owner:         p.owner,
+		Claims:        p.claims,
+		Grants:        p.grants,
+		PeerGroup:     p.group,
+		Created:       p.created,
+		Expires:       p.expires,
+		LastHandshake: dp.LastHandshakeTime,
+		ReceiveBytes:  dp.ReceiveBytes,
+		TransmitBytes: dp.TransmitBytes,
+	}
+}
+
+// RemovePeersByClaim evicts all peers whose token had the given string claim, e.g. all peers of a repository
+func (b *Bastion) RemovePeersByClaim(ctx context.Context, claim string, value string) ([]wgtypes.Key, error) {
+	b.peersMu.Lock()
+	defer b.peersMu.Unlock()
+
+	keys := make([]wgtypes.Key, 0)
+	for key, p := range b.peers {
+		if v, ok := p.claims[claim].(string); ok && v == value {
+			keys = append(keys, key)
+		}
+	}
+
+	err := b.removePeers(ctx, keys, removedEvicted)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Info("removed peers by claim", "claim", claim, "value", value, "peers", keyStrings(keys))
+	return keys, nil
+}
+
+// RemovePeer removes a single peer from the device and releases its address.
+func (b *Bastion) RemovePeer(ctx context.Context, key wgtypes.Key) error {
+	b.peersMu.Lock()
+	defer b.peersMu.Unlock()
+
+	if _, ok := b.peers[key]; !ok {
+		return ErrPeerNotFound
+	}
+
+	err := b.removePeers(ctx, []wgtypes.Key{key}, removedEvicted)
+	if err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Info("removed peer", "peer", key.String())
+	return nil
+}
+
+// RemoveOwnedPeer removes a peer only if it was issued to the given identity.
+func (b *Bastion) RemoveOwnedPeer(ctx context.Context, key wgtypes.Key, owner Identity) error {
+	b.peersMu.Lock()
+	defer b.peersMu.Unlock()
+
+	p, ok := b.peers[key]
+	if !ok {
+		return ErrPeerNotFound
+	}
+	if p.owner != owner {
+		return ErrPeerOwnerMismatch
+	}
+
+	err := b.removePeers(ctx, []wgtypes.Key{key}, removedDeleted)
+	if err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Info("removed peer on request of its owner", "peer", key.String(), "owner", owner.String())
+	return nil
+}
 
-	log.Default().Printf("found %d candidates for deletion", len(badPeers))
+// removePeers must be called with peersMu held, reason ends up in metrics and the audit log
+func (b *Bastion) removePeers(ctx context.Context, keys []wgtypes.Key, reason string) error {
+	if len(keys) == 0 {
+		return nil
+	}
 
-	peersToRemove := make([]wgtypes.PeerConfig, 0, len(badPeers))
-	for _, peerToRemove := range b.peerCleanupStabilizer.Iterate(badPeers) {
-		peersToRemove = append(peersToRemove, wgtypes.PeerConfig{
-			PublicKey: peerToRemove,
+	peerConfigs := make([]wgtypes.PeerConfig, 0, len(keys))
+	for _, key := range keys {
+		peerConfigs = append(peerConfigs, wgtypes.PeerConfig{
+			PublicKey: key,
 			Remove:    true,
 		})
 	}
 
-	log.Default().Printf("deleting peers: %v", peersToRemove)
-
-	err = b.Client.ConfigureDevice(b.Config.DeviceName, wgtypes.Config{Peers: peersToRemove})
+	err := b.Device.Configure(wgtypes.Config{Peers: peerConfigs})
 	if err != nil {
 		return err
 	}
 
+	removed := make([]*peer, 0, len(keys))
+	for _, key := range keys {
+		p, ok := b.peers[key]
+		if !ok {
+			// not one of ours, e.g. added by hand
+			continue
+		}
+		removed = append(removed, p)
+		delete(b.peers, key)
+
+		err = b.audit.Append(p.auditEntry(ctx, audit.EventEnd, key, reason))
+		if err != nil {
+			logging.FromContext(ctx).Error("unable to audit removal of peer", "peer", key.String(), "error", err)
+		}
+		b.webhooks.Notify(p.webhookEvent(webhook.EventPeerRemoved, key, reason))
+	}
+	peersRemoved.Add(reason, float64(len(removed)))
+
+	err = b.applyFirewall()
+	if err != nil {
+		// stale rules are replaced with the next successful apply, the addresses can still be reused
+		slog.Error("unable to remove firewall rules of removed peers", "error", err)
+	}
+
+	// only give addresses back once the device no longer routes them to the old peer
+	for _, p := range removed {
+		b.releaseIPs(p.ips)
+	}
+	b.saveState()
+
 	return nil
 }
 
+func (b *Bastion) releaseIPs(ips []*ipam.IP) {
+	for _, ip := range ips {
+		_, err := b.ipam.ReleaseIP(ip)
+		if err != nil {
+			slog.Error("unable to release ip", "ip", ip.IP.String(), "error", err)
+		}
+	}
+}
+
+// poolPrefixes returns the networks of a pool, the tunnel networks for the empty name
+func (b *Bastion) poolPrefixes(name string) ([]*net.IPNet, error) {
+	if name == "" {
+		return b.prefixes, nil
+	}
+	prefixes, ok := b.pools[name]
+	if !ok {
+		return nil, errors.Wrap(ErrUnknownPool, name)
+	}
+	return prefixes, nil
+}
+
+// allPrefixes returns the tunnel networks followed by the networks of all pools
+func (b *Bastion) allPrefixes() []*net.IPNet {
+	return allPrefixes(b.prefixes, b.pools)
+}
+
+func allPrefixes(prefixes []*net.IPNet, pools map[string][]*net.IPNet) []*net.IPNet {
+	all := append([]*net.IPNet{}, prefixes...)
+	for _, name := range poolNames(pools) {
+		all = append(all, pools[name]...)
+	}
+	return all
+}
+
+func poolNames(pools map[string][]*net.IPNet) []string {
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// prefixIn finds the prefix an address belongs to
+func prefixIn(prefixes []*net.IPNet, ip net.IP) (*net.IPNet, bool) {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return prefix, true
+		}
+	}
+	return nil, false
+}
+
+// hostNet returns a /32 or /128 network for an address
+func hostNet(ip *ipam.IP) net.IPNet {
+	if ip.IP.Is4() {
+		return net.IPNet{IP: ip.IP.IPAddr().IP, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip.IP.IPAddr().IP, Mask: net.CIDRMask(128, 128)}
+}
+
+// applyFirewall replaces all rules in the bastion's table, it must be called with peersMu held
+func (b *Bastion) applyFirewall() error {
+	if b.Firewall == nil {
+		return nil
+	}
+
+	ruleset := &nft.Ruleset{
+		Interface:      b.Config.DeviceName,
+		TunnelPrefixes: b.allPrefixes(),
+		RoutedNetworks: b.routedNetworks,
+		Peers:          make([]nft.Peer, 0, len(b.peers)),
+		PeerIsolation:  !b.Config.DisablePeerIsolation,
+	}
+	for _, p := range b.peers {
+		ruleset.Peers = append(ruleset.Peers, p.firewallRules())
+	}
+
+	err := b.Firewall.Apply(ruleset)
+	if err != nil {
+		return errors.Wrap(err, "unable to apply firewall rules")
+	}
+	return nil
+}
+
+// addresses returns the tunnel addresses of a peer for logging
+func (p *peer) addresses() []string {
+	addresses := make([]string, 0, len(p.ips))
+	for _, ip := range p.ips {
+		addresses = append(addresses, ip.IP.String())
+	}
+	return addresses
+}
+
+func keyStrings(keys []wgtypes.Key) []string {
+	strs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		strs = append(strs, key.String())
+	}
+	return strs
+}
+
+func (p *peer) firewallRules() nft.Peer {
+	rules := nft.Peer{Addresses: make([]net.IP, 0, len(p.ips)), Group: p.group}
+	for _, ip := range p.ips {
+		rules.Addresses = append(rules.Addresses, ip.IP.IPAddr().IP)
+	}
+	if p.grants == nil {
+		return rules
+	}
+
+	rules.Grants = make([]nft.Grant, 0, len(p.grants))
+	for _, grant := range p.grants {
+		network, err := grant.Network()
+		if err != nil {
+			// policies are validated when loaded, so this is a corrupted state file at worst
+			slog.Warn("skipping invalid grant", "cidr", grant.CIDR, "error", err)
+			continue
+		}
+		rules.Grants = append(rules.Grants, nft.Grant{
+			Network:  network,
+			Protocol: grant.Protocol,
+			Ports:    grant.Ports,
+		})
+	}
+	return rules
+}
+
 func (b *Bastion) Destroy() error {
-	return netlink.LinkDel(b.link)
+	if b.Firewall != nil {
+		err := b.Firewall.Destroy()
+		if err != nil {
+			slog.Error("unable to remove firewall rules", "error", err)
+		}
+	}
+	err := b.audit.Close()
+	if err != nil {
+		slog.Error("unable to close audit log", "error", err)
+	}
+	b.webhooks.Close()
+	return b.Device.Destroy()
 }
 
 func (b *Bastion) ServerInfo() BastionServerInfo {
+	gatewayIPs := make([]string, 0, len(b.gatewayIPs))
+	for _, ip := range b.gatewayIPs {
+		gatewayIPs = append(gatewayIPs, ip.IP.String())
+	}
+	routedNetworks := make([]string, 0, len(b.routedNetworks))
+	for _, network := range b.routedNetworks {
+		routedNetworks = append(routedNetworks, network.String())
+	}
 	return BastionServerInfo{
-		EndpointHost: b.Config.ExternalHostname,
-		EndpointPort: b.Config.Port,
-		GatewayIP:    b.gatewayIP.IP.String(),
-		PublicKey:    b.publicKey.String(),
+		EndpointHost:   b.Config.ExternalHostname,
+		EndpointPort:   b.Config.Port,
+		GatewayIPs:     gatewayIPs,
+		PublicKey:      b.publicKey.String(),
+		RoutedNetworks: routedNetworks,
 	}
 }
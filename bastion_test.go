@@ -1,12 +1,540 @@
 package tinybastion
 
 import (
+	"context"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/acuteaura/tinybastion/internal/metrics"
+	"github.com/acuteaura/tinybastion/internal/nft"
+	"github.com/acuteaura/tinybastion/internal/policy"
+	"github.com/jonboulle/clockwork"
+	"github.com/metal-stack/go-ipam"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 func TestWG(t *testing.T) {
 	if os.Getuid() != 0 {
 		t.Skip("need root to test wireguard")
 	}
+	if _, err := os.Stat("/sys/module/wireguard"); err != nil {
+		t.Skip("need the wireguard kernel module")
+	}
+	testBackend(t, BackendKernel)
+}
+
+func TestWG_Userspace(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("need root to test wireguard")
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skip("need /dev/net/tun")
+	}
+	testBackend(t, BackendUserspace)
+}
+
+func testBackend(t *testing.T, backend string) {
+	b, err := New(Config{
+		DeviceName:           "tbtest0",
+		Backend:              backend,
+		Port:                 45555,
+		PersistentKeepalive:  30,
+		CIDR:                 "10.250.0.0/29",
+		DisablePeerIsolation: true,
+	})
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, b.Destroy())
+	}()
+
+	key := generateKey(t)
+	pc, err := b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity})
+	require.NoError(t, err)
+
+	device, err := b.Device.Device()
+	require.NoError(t, err)
+	assert.Equal(t, 45555, device.ListenPort)
+	require.Len(t, device.Peers, 1)
+	assert.Equal(t, key, device.Peers[0].PublicKey)
+	assert.Equal(t, *pc.PresharedKey, device.Peers[0].PresharedKey)
+	assert.Equal(t, pc.AllowedIPs, device.Peers[0].AllowedIPs)
+
+	require.NoError(t, b.RemovePeer(context.Background(), key))
+	device, err = b.Device.Device()
+	require.NoError(t, err)
+	assert.Empty(t, device.Peers)
+}
+
+var testIdentity = Identity{Issuer: "https://issuer.example", Subject: "repo:acuteaura/tinybastion:ref:refs/heads/main"}
+
+func newTestBastion(t *testing.T, cidr string) (*Bastion, *MemoryDevice) {
+	device := NewMemoryDevice("test")
+	b, err := NewWithDevice(Config{
+		DeviceName:           "test",
+		PersistentKeepalive:  30,
+		CIDR:                 cidr,
+		DisablePeerIsolation: true,
+	}, device, nil)
+	require.NoError(t, err)
+	return b, device
+}
+
+func generateKey(t *testing.T) wgtypes.Key {
+	key, err := wgtypes.GeneratePrivateKey()
+	require.NoError(t, err)
+	return key.PublicKey()
+}
+
+func devicePeers(t *testing.T, device *MemoryDevice) map[wgtypes.Key]wgtypes.Peer {
+	d, err := device.Device()
+	require.NoError(t, err)
+	peers := make(map[wgtypes.Key]wgtypes.Peer)
+	for _, p := range d.Peers {
+		peers[p.PublicKey] = p
+	}
+	return peers
+}
+
+func TestBastion_Init(t *testing.T) {
+	device := NewMemoryDevice("test")
+	b, err := NewWithDevice(Config{
+		DeviceName:          "test",
+		Port:                5555,
+		PersistentKeepalive: 30,
+		CIDR:                "10.0.0.0/24",
+		CIDR6:               "fd00::/64",
+		RoutedNetworks:      []string{"192.168.0.0/16"},
+	}, device, &fakeFirewall{})
+	require.NoError(t, err)
+
+	require.Len(t, device.addresses, 2)
+	assert.Equal(t, "10.0.0.1/32", device.addresses[0].String())
+	assert.Equal(t, "fd00::1/128", device.addresses[1].String())
+	require.Len(t, device.routes, 2)
+	assert.Equal(t, "10.0.0.0/24", device.routes[0].String())
+	assert.Equal(t, "fd00::/64", device.routes[1].String())
+	assert.True(t, device.forwarding)
+
+	d, err := device.Device()
+	require.NoError(t, err)
+	assert.Equal(t, 5555, d.ListenPort)
+	assert.Equal(t, b.ServerInfo().PublicKey, d.PublicKey.String())
+	assert.Equal(t, []string{"10.0.0.1", "fd00::1"}, b.ServerInfo().GatewayIPs)
+}
+
+func TestBastion_RemovePeerReleasesIP(t *testing.T) {
+	// a /29 has 6 usable addresses, one of which is the gateway
+	b, device := newTestBastion(t, "10.0.0.0/29")
+
+	for i := 0; i < 100; i++ {
+		keys := make([]wgtypes.Key, 0, 5)
+		for j := 0; j < 5; j++ {
+			key := generateKey(t)
+			_, err := b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity})
+			require.NoError(t, err)
+			keys = append(keys, key)
+		}
+
+		_, err := b.AddPeer(context.Background(), generateKey(t), PeerOptions{Owner: testIdentity})
+		assert.ErrorIs(t, err, ipam.ErrNoIPAvailable)
+
+		for _, key := range keys {
+			require.NoError(t, b.RemovePeer(context.Background(), key))
+		}
+		assert.Empty(t, devicePeers(t, device))
+		assert.Empty(t, b.peers)
+	}
+}
+
+func TestBastion_RemovePeerUnknown(t *testing.T) {
+	b, _ := newTestBastion(t, "10.0.0.0/29")
+	assert.ErrorIs(t, b.RemovePeer(context.Background(), generateKey(t)), ErrPeerNotFound)
+}
+
+func TestBastion_CleanupPeersReleasesIP(t *testing.T) {
+	b, device := newTestBastion(t, "10.0.0.0/29")
+
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 5; j++ {
+			_, err := b.AddPeer(context.Background(), generateKey(t), PeerOptions{Owner: testIdentity})
+			require.NoError(t, err)
+		}
+
+		// none of the peers ever handshake, so they are removed once the stabilizer threshold is reached
+		for j := 0; j < 3; j++ {
+			require.NoError(t, b.CleanupPeers())
+		}
+		assert.Empty(t, devicePeers(t, device))
+		assert.Empty(t, b.peers)
+	}
+}
+
+func TestBastion_CleanupPeersKeepsActivePeers(t *testing.T) {
+	b, device := newTestBastion(t, "10.0.0.0/29")
+
+	active := generateKey(t)
+	_, err := b.AddPeer(context.Background(), active, PeerOptions{Owner: testIdentity})
+	require.NoError(t, err)
+	stale := generateKey(t)
+	_, err = b.AddPeer(context.Background(), stale, PeerOptions{Owner: testIdentity})
+	require.NoError(t, err)
+
+	for j := 0; j < 3; j++ {
+		require.NoError(t, device.SetLastHandshake(active, clock.Now()))
+		require.NoError(t, b.CleanupPeers())
+	}
+
+	peers := devicePeers(t, device)
+	assert.Contains(t, peers, active)
+	assert.NotContains(t, peers, stale)
+}
+
+func TestBastion_ReapExpiredPeers(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	clock = fakeClock
+	defer func() { clock = clockwork.NewRealClock() }()
+
+	device := NewMemoryDevice("test")
+	b, err := NewWithDevice(Config{
+		DeviceName:           "test",
+		PersistentKeepalive:  30,
+		CIDR:                 "10.0.0.0/29",
+		DisablePeerIsolation: true,
+		MaxSessionDuration:   time.Hour,
+	}, device, nil)
+	require.NoError(t, err)
+
+	shortToken := generateKey(t)
+	_, err = b.AddPeer(context.Background(), shortToken, PeerOptions{Owner: testIdentity, Expiry: fakeClock.Now().Add(10 * time.Minute)})
+	require.NoError(t, err)
+	longToken := generateKey(t)
+	_, err = b.AddPeer(context.Background(), longToken, PeerOptions{Owner: testIdentity, Expiry: fakeClock.Now().Add(24 * time.Hour)})
+	require.NoError(t, err)
+	noToken := generateKey(t)
+	_, err = b.AddPeer(context.Background(), noToken, PeerOptions{Owner: testIdentity})
+	require.NoError(t, err)
+	assert.Equal(t, fakeClock.Now().Add(time.Hour), b.peers[longToken].expires)
+
+	require.NoError(t, b.ReapExpiredPeers())
+	assert.Len(t, devicePeers(t, device), 3)
+
+	// handshakes don't keep an expired peer alive
+	fakeClock.Advance(10 * time.Minute)
+	require.NoError(t, device.SetLastHandshake(shortToken, fakeClock.Now()))
+	require.NoError(t, b.ReapExpiredPeers())
+	assert.NotContains(t, devicePeers(t, device), shortToken)
+	assert.Len(t, b.peers, 2)
+
+	fakeClock.Advance(50 * time.Minute)
+	require.NoError(t, b.ReapExpiredPeers())
+	assert.Empty(t, devicePeers(t, device))
+	assert.Empty(t, b.peers)
+}
+
+func TestBastion_RenewPeer(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	clock = fakeClock
+	defer func() { clock = clockwork.NewRealClock() }()
+
+	b, err := NewWithDevice(Config{
+		DeviceName:           "test",
+		PersistentKeepalive:  30,
+		CIDR:                 "10.0.0.0/29",
+		DisablePeerIsolation: true,
+		MaxSessionDuration:   time.Hour,
+	}, NewMemoryDevice("test"), nil)
+	require.NoError(t, err)
+
+	key := generateKey(t)
+	_, err = b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity, Expiry: fakeClock.Now().Add(10 * time.Minute)})
+	require.NoError(t, err)
+	created := fakeClock.Now()
+
+	fakeClock.Advance(5 * time.Minute)
+	expires, err := b.RenewPeer(context.Background(), key, testIdentity, fakeClock.Now().Add(10*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, fakeClock.Now().Add(10*time.Minute), expires)
+
+	// renewals don't extend the session past its maximum
+	for i := 0; i < 10; i++ {
+		fakeClock.Advance(5 * time.Minute)
+		expires, err = b.RenewPeer(context.Background(), key, testIdentity, fakeClock.Now().Add(10*time.Minute))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, created.Add(time.Hour), expires)
+
+	other := Identity{Issuer: testIdentity.Issuer, Subject: "repo:someone/else:ref:refs/heads/main"}
+	_, err = b.RenewPeer(context.Background(), key, other, fakeClock.Now().Add(10*time.Minute))
+	assert.ErrorIs(t, err, ErrPeerOwnerMismatch)
+
+	fakeClock.Advance(5 * time.Minute)
+	_, err = b.RenewPeer(context.Background(), key, testIdentity, fakeClock.Now().Add(10*time.Minute))
+	assert.ErrorIs(t, err, ErrPeerExpired)
+
+	_, err = b.RenewPeer(context.Background(), generateKey(t), testIdentity, fakeClock.Now().Add(10*time.Minute))
+	assert.ErrorIs(t, err, ErrPeerNotFound)
+}
+
+func TestBastion_AddPeerIdempotent(t *testing.T) {
+	b, device := newTestBastion(t, "10.0.0.0/29")
+	key := generateKey(t)
+
+	first, err := b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity})
+	require.NoError(t, err)
+
+	// a retry gets the same address and PSK
+	retried, err := b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity})
+	require.NoError(t, err)
+	assert.Equal(t, first.AllowedIPs, retried.AllowedIPs)
+	assert.Equal(t, *first.PresharedKey, *retried.PresharedKey)
+	assert.Len(t, b.peers, 1)
+
+	rotated, err := b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity, RotatePSK: true})
+	require.NoError(t, err)
+	assert.Equal(t, first.AllowedIPs, rotated.AllowedIPs)
+	assert.NotEqual(t, *first.PresharedKey, *rotated.PresharedKey)
+	peers := devicePeers(t, device)
+	assert.Equal(t, *rotated.PresharedKey, peers[key].PresharedKey)
+	assert.Equal(t, first.AllowedIPs, peers[key].AllowedIPs)
+
+	other := Identity{Issuer: testIdentity.Issuer, Subject: "repo:someone/else:ref:refs/heads/main"}
+	_, err = b.AddPeer(context.Background(), key, PeerOptions{Owner: other})
+	assert.ErrorIs(t, err, ErrPeerOwnerMismatch)
+	assert.Equal(t, *rotated.PresharedKey, devicePeers(t, device)[key].PresharedKey)
+
+	// no address was leaked along the way, a /29 still fits four more peers
+	for i := 0; i < 4; i++ {
+		_, err = b.AddPeer(context.Background(), generateKey(t), PeerOptions{Owner: testIdentity})
+		require.NoError(t, err)
+	}
+}
+
+func TestBastion_MaxPeersPerRun(t *testing.T) {
+	b, _ := newTestBastion(t, "10.0.0.0/29")
+	b.Config.MaxPeersPerRun = 1
+	run := map[string]interface{}{"run_id": "42", "run_attempt": "1"}
+
+	key := generateKey(t)
+	_, err := b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity, Claims: run})
+	require.NoError(t, err)
+	// the peer itself can still be retried
+	_, err = b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity, Claims: run})
+	require.NoError(t, err)
+	_, err = b.AddPeer(context.Background(), generateKey(t), PeerOptions{Owner: testIdentity, Claims: run})
+	assert.ErrorIs(t, err, ErrRunPeerLimit)
+
+	// a rerun is a different run, and tokens without a run aren't capped
+	_, err = b.AddPeer(context.Background(), generateKey(t), PeerOptions{Owner: testIdentity, Claims: map[string]interface{}{"run_id": "42", "run_attempt": "2"}})
+	require.NoError(t, err)
+	_, err = b.AddPeer(context.Background(), generateKey(t), PeerOptions{Owner: testIdentity})
+	require.NoError(t, err)
+
+	// removing the peer makes room again
+	require.NoError(t, b.RemovePeer(context.Background(), key))
+	_, err = b.AddPeer(context.Background(), generateKey(t), PeerOptions{Owner: testIdentity, Claims: run})
+	require.NoError(t, err)
+}
+
+func TestBastion_Collect(t *testing.T) {
+	b, device := newTestBastion(t, "10.0.0.0/29")
+	stale := peersRemoved.Value(removedStale)
+
+	key := generateKey(t)
+	_, err := b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity})
+	require.NoError(t, err)
+
+	families := make(map[string]metrics.Family)
+	for _, f := range b.Collect() {
+		families[f.Name] = f
+	}
+	assert.Equal(t, float64(1), families["tinybastion_active_peers"].Samples[0].Value)
+	// network, broadcast, gateway and the peer
+	assert.Equal(t, []metrics.Sample{
+		{Labels: map[string]string{"prefix": "10.0.0.0/29", "state": "used"}, Value: 4},
+		{Labels: map[string]string{"prefix": "10.0.0.0/29", "state": "free"}, Value: 4},
+	}, families["tinybastion_ipam_addresses"].Samples)
+	require.Len(t, families["tinybastion_peer_receive_bytes_total"].Samples, 1)
+	assert.Equal(t, key.String(), families["tinybastion_peer_receive_bytes_total"].Samples[0].Labels["public_key"])
+
+	for j := 0; j < 3; j++ {
+		require.NoError(t, b.CleanupPeers())
+	}
+	assert.Empty(t, devicePeers(t, device))
+	assert.Equal(t, stale+1, peersRemoved.Value(removedStale))
+}
+
+func TestBastion_RemoveOwnedPeer(t *testing.T) {
+	b, device := newTestBastion(t, "10.0.0.0/29")
+	key := generateKey(t)
+	_, err := b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity})
+	require.NoError(t, err)
+
+	other := Identity{Issuer: testIdentity.Issuer, Subject: "repo:someone/else:ref:refs/heads/main"}
+	assert.ErrorIs(t, b.RemoveOwnedPeer(context.Background(), key, other), ErrPeerOwnerMismatch)
+	assert.Len(t, devicePeers(t, device), 1)
+
+	// another job run with the same subject doesn't own it either
+	otherRun := testIdentity
+	otherRun.Run = "42/1"
+	assert.ErrorIs(t, b.RemoveOwnedPeer(context.Background(), key, otherRun), ErrPeerOwnerMismatch)
+	assert.Len(t, devicePeers(t, device), 1)
+
+	assert.NoError(t, b.RemoveOwnedPeer(context.Background(), key, testIdentity))
+	assert.Empty(t, devicePeers(t, device))
+	assert.ErrorIs(t, b.RemoveOwnedPeer(context.Background(), key, testIdentity), ErrPeerNotFound)
+}
+
+func TestBastion_DualStack(t *testing.T) {
+	b, err := NewWithDevice(Config{
+		DeviceName:           "test",
+		PersistentKeepalive:  30,
+		CIDR:                 "10.0.0.0/29",
+		CIDR6:                "fd00::/125",
+		DisablePeerIsolation: true,
+	}, NewMemoryDevice("test"), nil)
+	require.NoError(t, err)
+
+	// the first address of each prefix belongs to the gateway
+	key := generateKey(t)
+	pc, err := b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity})
+	require.NoError(t, err)
+	require.Len(t, pc.AllowedIPs, 2)
+	assert.Equal(t, "10.0.0.2/32", pc.AllowedIPs[0].String())
+	assert.Equal(t, "fd00::2/128", pc.AllowedIPs[1].String())
+
+	require.NoError(t, b.RemovePeer(context.Background(), key))
+	pc, err = b.AddPeer(context.Background(), generateKey(t), PeerOptions{Owner: testIdentity})
+	require.NoError(t, err)
+	assert.Equal(t, "fd00::2/128", pc.AllowedIPs[1].String())
+}
+
+func TestConfig_Prefixes(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"v4 only", Config{CIDR: "10.0.0.0/24"}, false},
+		{"v6 only", Config{CIDR6: "fd00::/64"}, false},
+		{"dual stack", Config{CIDR: "10.0.0.0/24", CIDR6: "fd00::/64"}, false},
+		{"none", Config{}, true},
+		{"v6 as v4", Config{CIDR: "fd00::/64"}, true},
+		{"v4 as v6", Config{CIDR6: "10.0.0.0/24"}, true},
+		{"garbage", Config{CIDR: "10.0.0.0/33"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.config.prefixes()
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := Config{DeviceName: "tinybastion", Port: 5555, PersistentKeepalive: 30, CIDR: "10.0.0.0/24"}
+	require.NoError(t, valid.Validate())
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   string
+	}{
+		{"no device name", func(c *Config) { c.DeviceName = "" }, "device name is required"},
+		{"long device name", func(c *Config) { c.DeviceName = "tinybastion-0123" }, "longer than 15 characters"},
+		{"device name with slash", func(c *Config) { c.DeviceName = "wg/0" }, "not a valid interface name"},
+		{"backend", func(c *Config) { c.Backend = "boringtun" }, "unknown backend boringtun"},
+		{"port", func(c *Config) { c.Port = 70000 }, "port 70000 is not between 1 and 65535"},
+		{"keepalive", func(c *Config) { c.PersistentKeepalive = 0 }, "persistent keepalive 0"},
+		{"cidr", func(c *Config) { c.CIDR = "10.0.0.0/33" }, "invalid CIDR"},
+		{"max peers per run", func(c *Config) { c.MaxPeersPerRun = -1 }, "max peers per run -1 is negative"},
+		{"routed network", func(c *Config) { c.RoutedNetworks = []string{"192.168.0.0"} }, "invalid routed network 192.168.0.0"},
+		{"pool", func(c *Config) { c.Pools = map[string]Pool{"gitlab": {CIDR6: "10.0.1.0/24"}} }, "pool gitlab CIDR6 10.0.1.0/24 is not an IPv6 network"},
+		{"empty pool", func(c *Config) { c.Pools = map[string]Pool{"gitlab": {}} }, "at least one of pool gitlab CIDR and CIDR6 is required"},
+		{"pool overlap", func(c *Config) { c.Pools = map[string]Pool{"gitlab": {CIDR: "10.0.0.128/25"}} }, "pool gitlab network 10.0.0.128/25 overlaps with 10.0.0.0/24"},
+		{"webhook url", func(c *Config) { c.WebhookURLs = []string{"bot.example"}; c.WebhookSecret = "s" }, "not an absolute http(s) URL"},
+		{"webhook secret", func(c *Config) { c.WebhookURLs = []string{"https://bot.example"} }, "webhooks require a secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.modify(&c)
+			assert.ErrorContains(t, c.Validate(), tt.want)
+		})
+	}
+
+	// everything is reported at once
+	invalid := Config{DeviceName: "tinybastion", Port: -1, PersistentKeepalive: -1}
+	err := invalid.Validate()
+	assert.ErrorContains(t, err, "port -1")
+	assert.ErrorContains(t, err, "persistent keepalive -1")
+	assert.ErrorContains(t, err, "at least one of CIDR and CIDR6 is required")
+}
+
+type fakeFirewall struct {
+	ruleset *nft.Ruleset
+	err     error
+}
+
+func (f *fakeFirewall) Apply(ruleset *nft.Ruleset) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.ruleset = ruleset
+	return nil
+}
+
+func (f *fakeFirewall) Destroy() error {
+	f.ruleset = nil
+	return nil
+}
+
+func TestBastion_PeerFirewallRules(t *testing.T) {
+	firewall := &fakeFirewall{}
+	device := NewMemoryDevice("test")
+	b, err := NewWithDevice(Config{
+		DeviceName:          "test",
+		PersistentKeepalive: 30,
+		CIDR:                "10.0.0.0/29",
+		RoutedNetworks:      []string{"192.168.0.0/16"},
+	}, device, firewall)
+	require.NoError(t, err)
+	assert.Empty(t, firewall.ruleset.Peers)
+
+	key := generateKey(t)
+	_, err = b.AddPeer(context.Background(), key, PeerOptions{
+		Owner:  testIdentity,
+		Grants: []policy.Grant{{CIDR: "192.168.1.0/24", Protocol: "tcp", Ports: []uint16{5432}}},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, firewall.ruleset.Peers, 1)
+	peerRules := firewall.ruleset.Peers[0]
+	assert.Equal(t, "10.0.0.2", peerRules.Addresses[0].String())
+	require.Len(t, peerRules.Grants, 1)
+	assert.Equal(t, "192.168.1.0/24", peerRules.Grants[0].Network.String())
+	assert.Equal(t, []uint16{5432}, peerRules.Grants[0].Ports)
+
+	assert.True(t, firewall.ruleset.PeerIsolation)
+
+	grouped := generateKey(t)
+	_, err = b.AddPeer(context.Background(), grouped, PeerOptions{Owner: testIdentity, PeerGroup: "runners"})
+	require.NoError(t, err)
+	require.Len(t, firewall.ruleset.Peers, 2)
+	groups := []string{firewall.ruleset.Peers[0].Group, firewall.ruleset.Peers[1].Group}
+	assert.ElementsMatch(t, []string{"", "runners"}, groups)
+
+	require.NoError(t, b.RemovePeer(context.Background(), key))
+	require.NoError(t, b.RemovePeer(context.Background(), grouped))
+	assert.Empty(t, firewall.ruleset.Peers)
+
+	// a peer whose rules cannot be applied must not stay around
+	firewall.err = errors.New("nft is broken")
+	_, err = b.AddPeer(context.Background(), generateKey(t), PeerOptions{Owner: testIdentity})
+	assert.Error(t, err)
+	assert.Empty(t, devicePeers(t, device))
+	assert.Empty(t, b.peers)
 }
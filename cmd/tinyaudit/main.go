@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"github.com/acuteaura/tinybastion/internal/audit"
+	"log"
+	"os"
+)
+
+// usage: tinyaudit verify <audit log>
+// exits non-zero if the hash chain is broken, otherwise prints the number of entries and the last hash.
+// Compare the last hash with a previously recorded one to detect truncation.
+func main() {
+	if len(os.Args) != 3 || os.Args[1] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: tinyaudit verify <audit log>")
+		os.Exit(2)
+	}
+
+	f, err := os.Open(os.Args[2])
+	if err != nil {
+		log.Fatalf("could not open audit log: %s", err)
+	}
+	defer f.Close()
+
+	n, lastHash, err := audit.Verify(f)
+	if err != nil {
+		log.Fatalf("audit log is broken after %d valid entries: %s", n, err)
+	}
+	fmt.Printf("%d entries verified, last hash %s\n", n, lastHash)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to upper-cased flag names to get their environment variable, e.g. TINYBASTION_WG_PORT
+const envPrefix = "TINYBASTION_"
+
+// commandLineOnly are flags that make no sense in the config file or environment
+var commandLineOnly = map[string]bool{"config": true, "help": true}
+
+// loadSettings fills the flags from the config file and the environment, in that order.
+// Flags given on the command line take precedence over both. Config file keys are flag names.
+func loadSettings(fs *flag.FlagSet, configFile string, lookupEnv func(string) (string, bool)) error {
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	if configFile != "" {
+		values, err := readConfigFile(configFile)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if fs.Lookup(name) == nil || commandLineOnly[name] {
+				return errors.Errorf("%s: unknown setting %s", configFile, name)
+			}
+			err = fs.Set(name, values[name])
+			if err != nil {
+				return errors.Wrapf(err, "%s: invalid %s", configFile, name)
+			}
+		}
+	}
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if envErr != nil || commandLineOnly[f.Name] {
+			return
+		}
+		value, ok := lookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		err := fs.Set(f.Name, value)
+		if err != nil {
+			envErr = errors.Wrapf(err, "invalid %s", envName(f.Name))
+		}
+	})
+	if envErr != nil {
+		return envErr
+	}
+
+	for name, value := range explicit {
+		err := fs.Set(name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// readConfigFile returns the settings of a YAML file as flag values, sequences become comma separated lists
+func readConfigFile(filename string) (map[string]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read config file")
+	}
+
+	raw := make(map[string]interface{})
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse config file %s", filename)
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, v := range raw {
+		switch v := v.(type) {
+		case nil:
+			values[name] = ""
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, errors.Errorf("%s: %s must not be a mapping", filename, name)
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+// validateListeners checks the settings of the HTTP listeners and the issuers, which aren't part of tinybastion.Config
+func validateListeners(issuers []string, httpPort int, adminPort int, metricsPort int) error {
+	problems := make([]string, 0)
+
+	for _, issuer := range issuers {
+		u, err := url.Parse(issuer)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("issuer %s is not an absolute https URL", issuer))
+		}
+	}
+
+	if httpPort < 1 || httpPort > 65535 {
+		problems = append(problems, fmt.Sprintf("http port %d is not between 1 and 65535", httpPort))
+	}
+	if adminPort < 0 || adminPort > 65535 {
+		problems = append(problems, fmt.Sprintf("admin port %d is not between 0 and 65535", adminPort))
+	}
+	if metricsPort < 0 || metricsPort > 65535 {
+		problems = append(problems, fmt.Sprintf("metrics port %d is not between 0 and 65535", metricsPort))
+	}
+	if adminPort != 0 && adminPort == httpPort {
+		problems = append(problems, "admin port and http port must differ")
+	}
+	if metricsPort != 0 && (metricsPort == httpPort || metricsPort == adminPort) {
+		problems = append(problems, "metrics port must differ from the http and admin ports")
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testSettings struct {
+	deviceName     string
+	routedNetworks string
+	wgPort         int
+	httpPort       int
+	maxSession     time.Duration
+	peerIsolation  bool
+}
+
+func newTestFlagSet(s *testSettings) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("config", "", "")
+	fs.StringVar(&s.deviceName, "device-name", "tinybastion", "")
+	fs.StringVar(&s.routedNetworks, "routed-networks", "", "")
+	fs.IntVar(&s.wgPort, "wg-port", 5555, "")
+	fs.IntVar(&s.httpPort, "http-port", 8080, "")
+	fs.DurationVar(&s.maxSession, "max-session-duration", 0, "")
+	fs.BoolVar(&s.peerIsolation, "peer-isolation", true, "")
+	return fs
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "tinybastion.yaml")
+	require.NoError(t, os.WriteFile(filename, []byte(content), 0600))
+	return filename
+}
+
+func TestLoadSettings(t *testing.T) {
+	configFile := writeConfigFile(t, `
+device-name: from-file
+wg-port: 51820
+http-port: 9000
+routed-networks:
+  - 192.168.10.0/24
+  - fd12::/64
+max-session-duration: 2h
+peer-isolation: false
+`)
+	env := map[string]string{"TINYBASTION_WG_PORT": "51821", "TINYBASTION_HTTP_PORT": "9001"}
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	s := &testSettings{}
+	fs := newTestFlagSet(s)
+	require.NoError(t, fs.Parse([]string{"-http-port", "9002"}))
+	require.NoError(t, loadSettings(fs, configFile, lookupEnv))
+
+	// file over defaults, environment over file, flags over everything
+	assert.Equal(t, "from-file", s.deviceName)
+	assert.Equal(t, 51821, s.wgPort)
+	assert.Equal(t, 9002, s.httpPort)
+	assert.Equal(t, "192.168.10.0/24,fd12::/64", s.routedNetworks)
+	assert.Equal(t, 2*time.Hour, s.maxSession)
+	assert.False(t, s.peerIsolation)
+}
+
+func TestLoadSettings_Errors(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+
+	fs := newTestFlagSet(&testSettings{})
+	err := loadSettings(fs, writeConfigFile(t, "wg_port: 5555\n"), noEnv)
+	assert.ErrorContains(t, err, "unknown setting wg_port")
+
+	fs = newTestFlagSet(&testSettings{})
+	err = loadSettings(fs, writeConfigFile(t, "wg-port: lots\n"), noEnv)
+	assert.ErrorContains(t, err, "invalid wg-port")
+
+	fs = newTestFlagSet(&testSettings{})
+	err = loadSettings(fs, writeConfigFile(t, "config: other.yaml\n"), noEnv)
+	assert.ErrorContains(t, err, "unknown setting config")
+
+	fs = newTestFlagSet(&testSettings{})
+	err = loadSettings(fs, "", func(name string) (string, bool) { return "soon", name == "TINYBASTION_MAX_SESSION_DURATION" })
+	assert.ErrorContains(t, err, "invalid TINYBASTION_MAX_SESSION_DURATION")
+}
+
+func TestValidateListeners(t *testing.T) {
+	assert.NoError(t, validateListeners([]string{"https://token.actions.githubusercontent.com", "https://gitlab.example.com"}, 8080, 8081, 9100))
+	assert.ErrorContains(t, validateListeners([]string{"https://gitlab.example.com", "token.actions.githubusercontent.com"}, 8080, 0, 0), "issuer")
+	assert.ErrorContains(t, validateListeners([]string{"https://issuer.example"}, 0, 0, 0), "http port 0")
+	assert.ErrorContains(t, validateListeners([]string{"https://issuer.example"}, 8080, 8080, 0), "admin port and http port must differ")
+	assert.ErrorContains(t, validateListeners([]string{"https://issuer.example"}, 8080, 8081, 8081), "metrics port must differ")
+}
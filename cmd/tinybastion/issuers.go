@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/acuteaura/tinybastion"
+	"github.com/acuteaura/tinybastion/internal/policy"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// issuerSettings is an entry of the -issuers file
+type issuerSettings struct {
+	URL      string `yaml:"url"`
+	Audience string `yaml:"audience"`
+	Policy   string `yaml:"policy"`
+	// CIDR and CIDR6 give the issuer its own address pool, its peers get addresses from the tunnel networks otherwise
+	CIDR  string `yaml:"cidr"`
+	CIDR6 string `yaml:"cidr6"`
+}
+
+// readIssuersFile reads a YAML list of issuers, unknown keys are rejected
+func readIssuersFile(filename string) ([]byte, []issuerSettings, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to read issuers file")
+	}
+
+	entries := make([]issuerSettings, 0)
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&entries)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "unable to parse issuers file %s", filename)
+	}
+	if len(entries) == 0 {
+		return nil, nil, errors.Errorf("%s lists no issuers", filename)
+	}
+	return data, entries, nil
+}
+
+// loadIssuers reads the policies of the trusted issuers, from the -issuers file or -issuer and -policy.
+// Issuers with a network of their own get a pool named after their URL.
+func (s *settings) loadIssuers() error {
+	entries := []issuerSettings{{URL: s.issuer, Audience: s.audience, Policy: s.policyFile}}
+	if s.issuersFile != "" {
+		if s.policyFile != "" || s.audience != "" {
+			return errors.New("-policy and -audience can't be combined with -issuers, set them for each issuer in the issuers file")
+		}
+		var err error
+		s.issuersData, entries, err = readIssuersFile(s.issuersFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.issuers = make([]tinybastion.Issuer, 0, len(entries))
+	s.pools = make(map[string]tinybastion.Pool)
+	s.policyData = make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		if _, ok := s.policyData[entry.URL]; ok {
+			return errors.Errorf("issuer %s is listed more than once", entry.URL)
+		}
+		if entry.Audience == "" && !s.allowAnyAudience {
+			if s.issuersFile == "" {
+				return errors.New("no audience supplied, set -audience or -allow-any-audience to accept tokens minted for other services too")
+			}
+			return errors.Errorf("no audience supplied for issuer %s, set one or -allow-any-audience to accept tokens minted for other services too", entry.URL)
+		}
+		if entry.Policy == "" {
+			if s.issuersFile == "" {
+				return errors.New("no policy supplied, refusing to start without an authorization policy")
+			}
+			return errors.Errorf("no policy supplied for issuer %s, refusing to start without an authorization policy", entry.URL)
+		}
+		data, err := os.ReadFile(entry.Policy)
+		if err != nil {
+			return errors.Wrapf(err, "could not read policy of issuer %s", entry.URL)
+		}
+		pol, err := policy.Parse(data)
+		if err != nil {
+			return errors.Wrapf(err, "could not load policy of issuer %s", entry.URL)
+		}
+		s.policyData[entry.URL] = data
+
+		issuer := tinybastion.Issuer{URL: entry.URL, Audience: entry.Audience, Policy: pol}
+		if entry.CIDR != "" || entry.CIDR6 != "" {
+			issuer.Pool = entry.URL
+			s.pools[entry.URL] = tinybastion.Pool{CIDR: entry.CIDR, CIDR6: entry.CIDR6}
+		}
+		s.issuers = append(s.issuers, issuer)
+	}
+	return nil
+}
+
+// issuerURLs returns the URLs of all trusted issuers
+func (s *settings) issuerURLs() []string {
+	urls := make([]string, 0, len(s.issuers))
+	for _, issuer := range s.issuers {
+		urls = append(urls, issuer.URL)
+	}
+	return urls
+}
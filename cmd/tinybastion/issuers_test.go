@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/acuteaura/tinybastion"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadIssuers(t *testing.T) {
+	dir := t.TempDir()
+	githubPolicy := filepath.Join(dir, "github.json")
+	gitlabPolicy := filepath.Join(dir, "gitlab.json")
+	issuersFile := filepath.Join(dir, "issuers.yaml")
+	writeFile := func(filename string, content string) {
+		require.NoError(t, os.WriteFile(filename, []byte(content), 0600))
+	}
+	writeFile(githubPolicy, `{"rules": [{"name": "owner", "match": {"claim": "repository_owner", "exact": "acuteaura"}}]}`)
+	writeFile(gitlabPolicy, `{"rules": [{"name": "infra", "match": {"claim": "namespace_path", "exact": "infra"}}]}`)
+	writeFile(issuersFile, `
+- url: https://token.actions.githubusercontent.com
+  audience: tinybastion
+  policy: `+githubPolicy+`
+- url: https://gitlab.example.com
+  audience: https://bastion.example.com
+  policy: `+gitlabPolicy+`
+  cidr: 10.0.1.0/24
+`)
+	noEnv := func(string) (string, bool) { return "", false }
+
+	args := []string{"-issuers", issuersFile}
+	s, err := readSettings(args, noEnv)
+	require.NoError(t, err)
+	require.Len(t, s.issuers, 2)
+	assert.Equal(t, "https://token.actions.githubusercontent.com", s.issuers[0].URL)
+	assert.Empty(t, s.issuers[0].Pool)
+	assert.Equal(t, "https://gitlab.example.com", s.issuers[1].Pool)
+	assert.Equal(t, "https://bastion.example.com", s.issuers[1].Audience)
+	assert.Equal(t, map[string]tinybastion.Pool{"https://gitlab.example.com": {CIDR: "10.0.1.0/24"}}, s.bastionConfig().Pools)
+
+	_, err = readSettings([]string{"-issuers", issuersFile, "-policy", githubPolicy}, noEnv)
+	assert.ErrorContains(t, err, "-policy and -audience can't be combined with -issuers")
+
+	// an audience is required unless any is allowed explicitly
+	_, err = readSettings([]string{"-policy", githubPolicy}, noEnv)
+	assert.ErrorContains(t, err, "no audience supplied, set -audience or -allow-any-audience")
+	anyAudience, err := readSettings([]string{"-policy", githubPolicy, "-allow-any-audience"}, noEnv)
+	require.NoError(t, err)
+	assert.Empty(t, anyAudience.issuers[0].Audience)
+
+	// grants must stay within the routed networks
+	grantPolicy := filepath.Join(dir, "grants.json")
+	writeFile(grantPolicy, `{"rules": [{"name": "metadata", "match": {"claim": "repository_owner", "exact": "acuteaura"}, "networks": [{"cidr": "169.254.169.254/32"}]}]}`)
+	_, err = readSettings([]string{"-policy", grantPolicy, "-audience", "tinybastion", "-routed-networks", "192.168.0.0/16"}, noEnv)
+	assert.ErrorContains(t, err, "network 169.254.169.254/32 of rule metadata is not within the routed networks")
+
+	// issuers and their policies can be reloaded, their pools can't
+	tb, err := tinybastion.NewWithDevice(s.bastionConfig(), tinybastion.NewMemoryDevice(s.deviceName), nil)
+	require.NoError(t, err)
+	server := &fakeServer{}
+	r := &reloader{args: args, lookupEnv: noEnv, current: s, server: server, bastion: tb, level: &slog.LevelVar{}}
+
+	writeFile(gitlabPolicy, `{"rules": [{"name": "infra", "match": {"claim": "namespace_path", "exact": "platform"}}]}`)
+	changed, err := r.Reload(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"policy"}, changed)
+	require.Len(t, server.issuers, 2)
+	assert.Equal(t, "https://gitlab.example.com", server.issuers[1].URL)
+
+	writeFile(issuersFile, `
+- url: https://gitlab.example.com
+  audience: https://bastion.example.com
+  policy: `+gitlabPolicy+`
+  cidr: 10.0.2.0/24
+`)
+	_, err = r.Reload(context.Background())
+	assert.ErrorContains(t, err, "changing issuer address pools requires a restart")
+
+	writeFile(issuersFile, `
+- url: https://gitlab.example.com
+  policy: `+gitlabPolicy+`
+  pool: 10.0.2.0/24
+`)
+	_, err = readSettings(args, noEnv)
+	assert.ErrorContains(t, err, "field pool not found")
+}
@@ -2,53 +2,64 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/acuteaura/tinybastion"
-	"log"
+	"github.com/acuteaura/tinybastion/internal/logging"
+	"github.com/acuteaura/tinybastion/internal/metrics"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 )
 
 func main() {
-	var deviceName, externalHostname, cidr, oidcIssuer string
-	var wgPort, httpPort, persistentKeepalive int
-	var help bool
-
-	flag.StringVar(&deviceName, "device-name", "tinybastion", "wireguard device name (will be created/deleted)")
-	flag.StringVar(&externalHostname, "external-hostname", "localhost", "hostname to advertise in peer config for this instance")
-	flag.StringVar(&cidr, "cidr", "10.0.0.0/24", "network in CIDR format to allocate IPs from (including gateway)")
-	flag.StringVar(&oidcIssuer, "issuer", "https://token.actions.githubusercontent.com", "the expected issuer of the OIDC token")
-	flag.IntVar(&wgPort, "wg-port", 5555, "port for wireguard")
-	flag.IntVar(&httpPort, "http-port", 8080, "port for http")
-	flag.IntVar(&persistentKeepalive, "persistent-keepalive", 30, "persistentkeepalive value to use for WG")
-	flag.BoolVar(&help, "help", false, "print usage")
-
-	flag.Parse()
-
-	if help {
-		flag.Usage()
+	s, err := readSettings(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
 		return
 	}
+	if err != nil {
+		fatal("could not load settings", "error", err)
+	}
 
-	tb, err := tinybastion.New(tinybastion.Config{
-		DeviceName:          deviceName,
-		Port:                wgPort,
-		PersistentKeepalive: persistentKeepalive,
-		ExternalHostname:    externalHostname,
-		CIDR:                cidr,
-	})
+	level := &slog.LevelVar{}
+	level.Set(s.level)
+	slog.SetDefault(logging.New(os.Stderr, level))
+	for _, issuer := range s.issuers {
+		if issuer.Audience == "" {
+			slog.Warn("any audience allowed for issuer, its tokens for other services are accepted too", "issuer", issuer.URL)
+		}
+	}
+
+	tb, err := tinybastion.New(s.bastionConfig())
 	if err != nil {
 		panic(err)
 	}
 	defer func() {
 		err := tb.Destroy()
 		if err != nil {
-			log.Default().Printf("destroying interface failed, you may need to collect debris")
+			slog.Error("destroying interface failed, you may need to collect debris", "error", err)
 		}
 	}()
 
-	tinybastion.NewServer(context.TODO(), tb, httpPort, oidcIssuer)
+	server := tinybastion.NewServer(context.TODO(), tb, s.httpPort, s.issuers)
+	reloader := newReloader(s, server, tb, level)
+	if s.adminPort != 0 {
+		tinybastion.NewAdminServer(context.TODO(), tb, s.adminPort, s.adminToken, reloader.Reload)
+	}
+	if s.metricsPort != 0 {
+		metrics.Default.Register(tb)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Default)
+		go func() {
+			slog.Info("starting metrics server", "port", s.metricsPort)
+			err := http.ListenAndServe(fmt.Sprintf(":%d", s.metricsPort), mux)
+			fatal("metrics server error", "error", err)
+		}()
+	}
 
 	go func(ctx context.Context) {
 		for {
@@ -59,14 +70,35 @@ func main() {
 				if err != nil {
 					panic(err)
 				}
+				err = tb.ReapExpiredPeers()
+				if err != nil {
+					slog.Error("reaping expired peers failed", "error", err)
+				}
 			case <-ctx.Done():
 				return
 			}
 		}
 	}(context.TODO())
 
-	intChan := make(chan os.Signal)
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			_, err := reloader.Reload(context.Background())
+			if err != nil {
+				slog.Error("reload rejected", "error", err)
+			}
+		}
+	}()
+
+	intChan := make(chan os.Signal, 1)
 	signal.Notify(intChan, os.Interrupt, os.Kill)
 
 	<-intChan
 }
+
+// fatal logs an error and exits, like log.Fatal
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
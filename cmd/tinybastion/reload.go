@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/acuteaura/tinybastion"
+	"github.com/acuteaura/tinybastion/internal/logging"
+	"github.com/pkg/errors"
+)
+
+// reloadable are the settings that can change without recreating the interface or a listener
+var reloadable = map[string]bool{
+	"config":              true,
+	"issuer":              true,
+	"audience":            true,
+	"allow-any-audience":  true,
+	"issuers":             true,
+	"policy":              true,
+	"log-level":           true,
+	"webhook-urls":        true,
+	"webhook-secret-file": true,
+}
+
+// issuerReloader is the server as far as reloading is concerned, tests use it to avoid the
+// listener and issuer requests of a real one
+type issuerReloader interface {
+	Reload(issuers []tinybastion.Issuer)
+}
+
+// reloader applies changed settings to the running bastion, on SIGHUP or through the admin API
+type reloader struct {
+	mu        sync.Mutex
+	args      []string
+	lookupEnv func(string) (string, bool)
+	current   *settings
+
+	server  issuerReloader
+	bastion *tinybastion.Bastion
+	level   *slog.LevelVar
+}
+
+// Reload reads all settings again and applies them. It changes nothing and fails if a setting
+// that is not reloadable changed. It returns the names of the changed settings.
+func (r *reloader) Reload(ctx context.Context) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := readSettings(r.args, r.lookupEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make([]string, 0)
+	restart := make([]string, 0)
+	for name, value := range next.values {
+		if r.current.values[name] == value {
+			continue
+		}
+		if reloadable[name] {
+			changed = append(changed, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	// issuers may change, but not the address pools they use
+	if !reflect.DeepEqual(next.pools, r.current.pools) {
+		restart = append(restart, "issuer address pools")
+	}
+	sort.Strings(restart)
+	if len(restart) > 0 {
+		return nil, errors.Errorf("changing %s requires a restart", strings.Join(restart, ", "))
+	}
+
+	// the files behind the settings may have changed too
+	if !policiesEqual(next.policyData, r.current.policyData) && !slices.Contains(changed, "policy") {
+		changed = append(changed, "policy")
+	}
+	if !bytes.Equal(next.issuersData, r.current.issuersData) && !slices.Contains(changed, "issuers") {
+		changed = append(changed, "issuers")
+	}
+	webhooksChanged := slices.Contains(changed, "webhook-urls") || next.webhookSecret != r.current.webhookSecret
+	if next.webhookSecret != r.current.webhookSecret {
+		changed = append(changed, "webhook-secret")
+	}
+	sort.Strings(changed)
+
+	r.server.Reload(next.issuers)
+	r.level.Set(next.level)
+	if webhooksChanged {
+		r.bastion.SetWebhooks(splitList(next.webhookURLs), next.webhookSecret)
+	}
+	r.current = next
+
+	logging.FromContext(ctx).Info("reloaded settings", "changed", changed)
+	return changed, nil
+}
+
+// policiesEqual compares the policy files of all issuers
+func policiesEqual(a map[string][]byte, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for url, data := range a {
+		other, ok := b[url]
+		if !ok || !bytes.Equal(data, other) {
+			return false
+		}
+	}
+	return true
+}
+
+func newReloader(s *settings, server issuerReloader, bastion *tinybastion.Bastion, level *slog.LevelVar) *reloader {
+	return &reloader{
+		args:      os.Args[1:],
+		lookupEnv: os.LookupEnv,
+		current:   s,
+		server:    server,
+		bastion:   bastion,
+		level:     level,
+	}
+}
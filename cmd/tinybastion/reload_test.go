@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/acuteaura/tinybastion"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer records the issuers it was reloaded with
+type fakeServer struct {
+	issuers []tinybastion.Issuer
+}
+
+func (f *fakeServer) Reload(issuers []tinybastion.Issuer) {
+	f.issuers = issuers
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.json")
+	configFile := filepath.Join(dir, "tinybastion.yaml")
+	writeFile := func(filename string, content string) {
+		require.NoError(t, os.WriteFile(filename, []byte(content), 0600))
+	}
+	writeFile(policyFile, `{"rules": [{"name": "owner", "match": {"claim": "repository_owner", "exact": "acuteaura"}}]}`)
+	writeFile(configFile, "policy: "+policyFile+"\naudience: tinybastion\nhttp-port: 0\nlog-level: info\n")
+	noEnv := func(string) (string, bool) { return "", false }
+
+	args := []string{"-config", configFile, "-http-port", "18080"}
+	s, err := readSettings(args, noEnv)
+	require.NoError(t, err)
+
+	tb, err := tinybastion.NewWithDevice(s.bastionConfig(), tinybastion.NewMemoryDevice(s.deviceName), nil)
+	require.NoError(t, err)
+	server := &fakeServer{}
+	level := &slog.LevelVar{}
+	r := &reloader{args: args, lookupEnv: noEnv, current: s, server: server, bastion: tb, level: level}
+
+	changed, err := r.Reload(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+
+	writeFile(policyFile, `{"rules": [{"name": "owner", "match": {"claim": "repository_owner", "exact": "someone"}}]}`)
+	writeFile(configFile, "policy: "+policyFile+"\naudience: tinybastion\nhttp-port: 0\nlog-level: debug\n")
+	changed, err = r.Reload(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log-level", "policy"}, changed)
+	assert.Equal(t, s.issuers[0].URL, server.issuers[0].URL)
+	assert.NotEqual(t, s.issuers[0].Policy, server.issuers[0].Policy)
+	assert.Equal(t, slog.LevelDebug, level.Level())
+
+	writeFile(configFile, "policy: "+policyFile+"\naudience: tinybastion\nhttp-port: 0\nlog-level: warn\nwg-port: 5556\ncidr: 10.1.0.0/24\n")
+	_, err = r.Reload(context.Background())
+	assert.ErrorContains(t, err, "changing cidr, wg-port requires a restart")
+	assert.Equal(t, slog.LevelDebug, level.Level())
+
+	writeFile(configFile, "policy: "+policyFile+"\naudience: tinybastion\nhttp-port: 0\nlog-level: loud\n")
+	_, err = r.Reload(context.Background())
+	assert.ErrorContains(t, err, "invalid log level")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/acuteaura/tinybastion"
+	"github.com/acuteaura/tinybastion/internal/logging"
+	"github.com/pkg/errors"
+)
+
+// settings are everything tinybastion is started with, read from flags, the environment and the config file
+type settings struct {
+	configFile, logLevel                    string
+	deviceName, backend, externalHostname   string
+	wgPort, persistentKeepalive             int
+	maxPeersPerRun                          int
+	cidr, cidr6, routedNetworks             string
+	peerIsolation                           bool
+	maxSessionDuration                      time.Duration
+	issuer, audience                        string
+	allowAnyAudience                        bool
+	policyFile, issuersFile                 string
+	privateKeyFile, stateFile, auditLogFile string
+	httpPort, adminPort, metricsPort        int
+	adminTokenFile                          string
+	webhookURLs, webhookSecretFile          string
+
+	// values of all flags, to find out what a reload changes
+	values map[string]string
+
+	// what the settings point to
+	level   slog.Level
+	issuers []tinybastion.Issuer
+	pools   map[string]tinybastion.Pool
+	// policyData and issuersData are the file contents, keyed by issuer URL
+	policyData    map[string][]byte
+	issuersData   []byte
+	adminToken    string
+	webhookSecret string
+}
+
+func (s *settings) register(fs *flag.FlagSet) {
+	fs.StringVar(&s.configFile, "config", "", "YAML file with settings keyed by flag name, overridden by TINYBASTION_<FLAG> environment variables and flags")
+	fs.StringVar(&s.deviceName, "device-name", "tinybastion", "wireguard device name (will be created/deleted)")
+	fs.StringVar(&s.backend, "backend", tinybastion.BackendKernel, "wireguard implementation, kernel or userspace (wireguard-go on a tun device, for hosts without the kernel module)")
+	fs.StringVar(&s.externalHostname, "external-hostname", "localhost", "hostname to advertise in peer config for this instance")
+	fs.StringVar(&s.cidr, "cidr", "10.0.0.0/24", "IPv4 network in CIDR format to allocate IPs from (including gateway), empty to disable")
+	fs.StringVar(&s.cidr6, "cidr6", "", "IPv6 network in CIDR format to allocate IPs from (including gateway), empty to disable")
+	fs.StringVar(&s.routedNetworks, "routed-networks", "", "comma separated networks in CIDR format to make reachable for peers (forwarded and masqueraded)")
+	fs.StringVar(&s.issuer, "issuer", "https://token.actions.githubusercontent.com", "the expected issuer of the OIDC token")
+	fs.StringVar(&s.audience, "audience", "", "the audience the OIDC token must be issued for, e.g. the URL of this instance (required unless -allow-any-audience)")
+	fs.BoolVar(&s.allowAnyAudience, "allow-any-audience", false, "accept tokens of issuers without an audience whatever their aud claim, including tokens minted for other services")
+	fs.StringVar(&s.policyFile, "policy", "", "path to a JSON file with the claim authorization policy (required without -issuers)")
+	fs.StringVar(&s.issuersFile, "issuers", "", "YAML file listing the trusted issuers with their policy and optionally an address pool of their own, replaces -issuer and -policy")
+	fs.StringVar(&s.privateKeyFile, "private-key-file", "", "file to keep the bastion private key in (created if absent), ephemeral if empty")
+	fs.StringVar(&s.stateFile, "state-file", "", "file to persist issued peers in, so they survive restarts")
+	fs.StringVar(&s.auditLogFile, "audit-log-file", "", "file to append a hash chained audit log of tunnel grants and removals to, disabled if empty")
+	fs.IntVar(&s.wgPort, "wg-port", 5555, "port for wireguard")
+	fs.IntVar(&s.httpPort, "http-port", 8080, "port for http")
+	fs.IntVar(&s.adminPort, "admin-port", 0, "port for the admin API, 0 to disable")
+	fs.StringVar(&s.adminTokenFile, "admin-token-file", "", "file containing the bearer token for the admin API (required with -admin-port)")
+	fs.StringVar(&s.webhookURLs, "webhook-urls", "", "comma separated URLs to POST peer lifecycle events to")
+	fs.StringVar(&s.webhookSecretFile, "webhook-secret-file", "", "file containing the secret webhook requests are signed with (required with -webhook-urls)")
+	fs.IntVar(&s.metricsPort, "metrics-port", 0, "port to serve prometheus metrics on at /metrics, 0 to disable")
+	fs.IntVar(&s.persistentKeepalive, "persistent-keepalive", 30, "persistentkeepalive value to use for WG")
+	fs.DurationVar(&s.maxSessionDuration, "max-session-duration", 0, "remove peers this long after they were created even if their token is still valid, 0 to only use the token expiry")
+	fs.IntVar(&s.maxPeersPerRun, "max-peers-per-run", 10, "how many tunnels a single CI job run (run_id and run_attempt claims) may have at once, 0 for no limit")
+	fs.BoolVar(&s.peerIsolation, "peer-isolation", true, "drop traffic between peers unless their policy rules share a peer_group")
+	fs.StringVar(&s.logLevel, "log-level", "info", "minimum level of logs, debug, info, warn or error")
+}
+
+// readSettings parses the command line, config file and environment, and loads and validates everything they point to
+func readSettings(args []string, lookupEnv func(string) (string, bool)) (*settings, error) {
+	s := &settings{}
+	fs := flag.NewFlagSet("tinybastion", flag.ContinueOnError)
+	s.register(fs)
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	err = loadSettings(fs, s.configFile, lookupEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	s.values = make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		s.values[f.Name] = f.Value.String()
+	})
+
+	return s, s.load()
+}
+
+func (s *settings) load() error {
+	var err error
+	s.level, err = logging.ParseLevel(s.logLevel)
+	if err != nil {
+		return errors.Wrap(err, "invalid log level")
+	}
+
+	err = s.loadIssuers()
+	if err != nil {
+		return err
+	}
+	err = validateListeners(s.issuerURLs(), s.httpPort, s.adminPort, s.metricsPort)
+	if err != nil {
+		return err
+	}
+
+	if s.adminPort != 0 {
+		if s.adminTokenFile == "" {
+			return errors.New("no admin token file supplied, refusing to start the admin API without authentication")
+		}
+		s.adminToken, err = readSecret(s.adminTokenFile)
+		if err != nil {
+			return errors.Wrap(err, "could not read admin token")
+		}
+	}
+
+	if s.webhookURLs != "" {
+		if s.webhookSecretFile == "" {
+			return errors.New("no webhook secret file supplied, refusing to send unsigned webhooks")
+		}
+		s.webhookSecret, err = readSecret(s.webhookSecretFile)
+		if err != nil {
+			return errors.Wrap(err, "could not read webhook secret")
+		}
+	}
+
+	config := s.bastionConfig()
+	err = config.Validate()
+	if err != nil {
+		return err
+	}
+	for _, issuer := range s.issuers {
+		err = config.ValidatePolicy(issuer.Policy)
+		if err != nil {
+			return errors.Wrapf(err, "invalid policy of issuer %s", issuer.URL)
+		}
+	}
+	return nil
+}
+
+func (s *settings) bastionConfig() tinybastion.Config {
+	return tinybastion.Config{
+		DeviceName:           s.deviceName,
+		Backend:              s.backend,
+		Port:                 s.wgPort,
+		PersistentKeepalive:  s.persistentKeepalive,
+		ExternalHostname:     s.externalHostname,
+		CIDR:                 s.cidr,
+		CIDR6:                s.cidr6,
+		Pools:                s.pools,
+		RoutedNetworks:       splitList(s.routedNetworks),
+		DisablePeerIsolation: !s.peerIsolation,
+		MaxSessionDuration:   s.maxSessionDuration,
+		MaxPeersPerRun:       s.maxPeersPerRun,
+		PrivateKeyFile:       s.privateKeyFile,
+		StateFile:            s.stateFile,
+		AuditLogFile:         s.auditLogFile,
+		WebhookURLs:          splitList(s.webhookURLs),
+		WebhookSecret:        s.webhookSecret,
+	}
+}
+
+// readSecret reads a token from a file, surrounding whitespace is ignored
+func readSecret(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", errors.Errorf("%s is empty", filename)
+	}
+	return secret, nil
+}
+
+// splitList splits a comma separated flag value, ignoring empty elements
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
@@ -6,17 +6,40 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/acuteaura/tinybastion"
+	"github.com/pkg/errors"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
+// usage: tinyclient [create|delete|renew], create is the default.
+// The token is read from OIDC_TOKEN, or requested for OIDC_AUDIENCE in GitHub Actions.
+// renew keeps extending the tunnel until it is killed, it fetches fresh tokens from
+// ACTIONS_ID_TOKEN_REQUEST_URL when running in GitHub Actions.
 func main() {
-	// Get OIDC Token
+	mode := "create"
+	if len(os.Args) > 1 {
+		mode = os.Args[1]
+	}
+
+	// Get OIDC Token, requesting one for OIDC_AUDIENCE from the Actions runtime if none is given
 	token, haveToken := os.LookupEnv("OIDC_TOKEN")
+	if !haveToken {
+		var err error
+		token, err = fetchActionsToken()
+		if err != nil {
+			log.Fatalf("Could not fetch OIDC token: %+v", err)
+		}
+		haveToken = token != ""
+	}
 	if !haveToken {
 		log.Default().Printf("Warning: proceeding without OIDC token (OIDC_TOKEN env was empty or not set).")
 	}
@@ -30,11 +53,6 @@ func main() {
 		log.Fatalf("Could not parse public key: %+v", err)
 	}
 
-	privateKey, ok := os.LookupEnv("PRIVATE_KEY")
-	if !ok {
-		log.Fatal("Cannot proceed without PRIVATE_KEY env set.")
-	}
-
 	marshallableKey := tinybastion.MarshallableKey{K: wgKey}
 
 	apiEndpoint, ok := os.LookupEnv("BASTION_API_ENDPOINT")
@@ -42,43 +60,200 @@ func main() {
 		log.Fatal("Cannot proceed without BASTION_API_ENDPOINT env set.")
 	}
 
-	client := http.Client{}
-	request := tinybastion.CreateTunnelRequest{
-		PublicKey: &marshallableKey,
+	switch mode {
+	case "create":
+		privateKey, ok := os.LookupEnv("PRIVATE_KEY")
+		if !ok {
+			log.Fatal("Cannot proceed without PRIVATE_KEY env set.")
+		}
+		// a tunnel that already exists for this key is returned as is, unless ROTATE_PSK=true
+		rotatePSK := os.Getenv("ROTATE_PSK") == "true"
+		createTunnel(apiEndpoint, token, &marshallableKey, privateKey, rotatePSK)
+	case "delete":
+		deleteTunnel(apiEndpoint, token, &marshallableKey)
+	case "renew":
+		renewTunnel(apiEndpoint, token, &marshallableKey)
+	default:
+		log.Fatalf("Unknown mode %s, expected create, delete or renew.", mode)
+	}
+}
+
+func doRequest(method string, apiEndpoint string, token string, request interface{}) *http.Response {
+	res, err := sendRequest(method, apiEndpoint, token, request)
+	if err != nil {
+		log.Fatalf("Could not send %s request: %+v", method, err)
+	}
+
+	if res.StatusCode >= 300 {
+		res.Body.Close()
+		log.Fatalf("Received a non 2xx response: %d (error id %s)", res.StatusCode, res.Header.Get("X-Error-ID"))
 	}
 
+	return res
+}
+
+func sendRequest(method string, apiEndpoint string, token string, request interface{}) (*http.Response, error) {
 	body, err := json.Marshal(request)
 	if err != nil {
-		log.Fatalf("Could not create request body: %+v", err)
+		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", apiEndpoint, bytes.NewBuffer(body))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, apiEndpoint, bytes.NewBuffer(body))
 	if err != nil {
-		log.Fatalf("Could not create new request: %+v", err)
+		return nil, err
 	}
 
 	req.Header.Add("Content-Type", "application/json")
 
-	if haveToken {
+	if token != "" {
 		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10)
-	req.WithContext(ctx)
+	client := http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// the timeout applies to reading the body too, so it has to be read before returning
+	data, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(data))
+
+	return res, nil
+}
+
+func deleteTunnel(apiEndpoint string, token string, key *tinybastion.MarshallableKey) {
+	res := doRequest(http.MethodDelete, apiEndpoint, token, tinybastion.DeleteTunnelRequest{
+		PublicKey: key,
+	})
+	res.Body.Close()
+	log.Default().Printf("Tunnel for %s deleted.", key.K)
+}
+
+func renewTunnel(apiEndpoint string, token string, key *tinybastion.MarshallableKey) {
+	renewEndpoint := strings.TrimSuffix(apiEndpoint, "/") + "/renew"
+
+	for {
+		expires, err := renewOnce(renewEndpoint, token, key)
+		if err != nil {
+			log.Default().Printf("Renewing tunnel for %s failed, retrying: %+v", key.K, err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		if expires.IsZero() {
+			log.Default().Printf("Tunnel for %s does not expire, nothing left to renew.", key.K)
+			return
+		}
+
+		// renew halfway to the expiry, so a failed attempt leaves time for another
+		wait := time.Until(expires) / 2
+		if wait < 10*time.Second {
+			wait = 10 * time.Second
+		}
+		log.Default().Printf("Tunnel for %s renewed until %s.", key.K, expires.Format(time.RFC3339))
+		time.Sleep(wait)
+	}
+}
+
+// renewOnce extends the tunnel with a fresh token, it exits if the tunnel cannot be renewed anymore
+func renewOnce(renewEndpoint string, token string, key *tinybastion.MarshallableKey) (time.Time, error) {
+	freshToken, err := fetchActionsToken()
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "could not fetch a fresh token")
+	}
+	if freshToken == "" {
+		log.Default().Printf("Warning: not running in GitHub Actions, renewing with the OIDC_TOKEN env, which will expire.")
+		freshToken = token
+	}
+
+	res, err := sendRequest(http.MethodPost, renewEndpoint, freshToken, tinybastion.RenewTunnelRequest{
+		PublicKey: key,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone || res.StatusCode == http.StatusForbidden:
+		log.Fatalf("Tunnel for %s can no longer be renewed: %d (error id %s)", key.K, res.StatusCode, res.Header.Get("X-Error-ID"))
+	case res.StatusCode >= 300:
+		return time.Time{}, errors.Errorf("received a non 2xx response: %d (error id %s)", res.StatusCode, res.Header.Get("X-Error-ID"))
+	}
+
+	var response tinybastion.RenewTunnelResponse
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "could not unmarshall response into RenewTunnelResponse")
+	}
+	return response.Expires, nil
+}
+
+// fetchActionsToken requests a new ID token from the GitHub Actions runtime, it returns an empty string outside of Actions.
+// The audience can be set with OIDC_AUDIENCE.
+func fetchActionsToken() (string, error) {
+	requestURL, ok := os.LookupEnv("ACTIONS_ID_TOKEN_REQUEST_URL")
+	if !ok {
+		return "", nil
+	}
+	requestToken := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN")
+
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return "", err
+	}
+	if audience, ok := os.LookupEnv("OIDC_AUDIENCE"); ok {
+		q := u.Query()
+		q.Set("audience", audience)
+		u.RawQuery = q.Encode()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	res, err := client.Do(req)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", requestToken))
+
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Fatalf("Could not send POST request: %+v", err)
+		return "", err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode >= 300 {
-		log.Fatalf("Received a non 2xx response: %d", res.StatusCode)
+		return "", errors.Errorf("token request failed with status %d", res.StatusCode)
 	}
 
-	var response tinybastion.CreateTunnelResponse
+	var response struct {
+		Value string `json:"value"`
+	}
 	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return "", err
+	}
+	return response.Value, nil
+}
+
+func createTunnel(apiEndpoint string, token string, key *tinybastion.MarshallableKey, privateKey string, rotatePSK bool) {
+	res := doRequest(http.MethodPost, apiEndpoint, token, tinybastion.CreateTunnelRequest{
+		PublicKey: key,
+		RotatePSK: rotatePSK,
+	})
+	defer res.Body.Close()
+
+	var response tinybastion.CreateTunnelResponse
+	err := json.NewDecoder(res.Body).Decode(&response)
 	if err != nil {
 		log.Fatalf("Could not unmarshall response into CreateTunnelResponse: %+v", err)
 	}
@@ -86,6 +261,8 @@ func main() {
 	var config struct {
 		tinybastion.MarshallablePeerConfig
 
+		Address             string
+		Endpoint            string
 		ListenPort          int
 		PrivateKey          string
 		AllowedIPs          string
@@ -94,18 +271,24 @@ func main() {
 	}
 	config.P = response.PeerConfig.P
 	config.BSI = response.PeerConfig.BSI
+	addresses := make([]string, 0, len(response.PeerConfig.P.AllowedIPs))
+	for _, ipNet := range response.PeerConfig.P.AllowedIPs {
+		addresses = append(addresses, ipNet.String())
+	}
+	config.Address = strings.Join(addresses, ", ")
+	config.Endpoint = net.JoinHostPort(response.PeerConfig.BSI.EndpointHost, strconv.Itoa(response.PeerConfig.BSI.EndpointPort))
 	config.ListenPort = 55555
 	config.PrivateKey = privateKey
-	config.AllowedIPs = strings.Join([]string{
-		response.PeerConfig.BSI.GatewayIP,
-		// TODO: Make this configurable
-	})
+	// route the gateway and everything the bastion forwards for us through the tunnel
+	allowedIPs := append([]string{}, response.PeerConfig.BSI.GatewayIPs...)
+	allowedIPs = append(allowedIPs, response.PeerConfig.BSI.RoutedNetworks...)
+	config.AllowedIPs = strings.Join(allowedIPs, ", ")
 	config.DNS = "1.1.1.1" // TODO: this too
 	config.PersistentKeepalive = int(response.PeerConfig.P.PersistentKeepaliveInterval.Seconds())
 
 	configTemplate, err := template.New("config").Parse(`
 [Interface]
-Address = {{index .P.AllowedIPs 0}}
+Address = {{.Address}}
 ListenPort = {{.ListenPort}}
 PrivateKey = {{.PrivateKey}}
 DNS = {{.DNS}}
@@ -116,7 +299,7 @@ PostDown = iptables -D FORWARD -i client -j ACCEPT; iptables -t nat -D POSTROUTI
 # Bastion
 PublicKey = {{.BSI.PublicKey}}
 PresharedKey = {{.P.PresharedKey}}
-Endpoint = {{.BSI.EndpointHost}}:{{.BSI.EndpointPort}}
+Endpoint = {{.Endpoint}}
 AllowedIPs = {{.AllowedIPs}}
 PersistentKeepalive = {{.PersistentKeepalive}}
 `)
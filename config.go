@@ -1,9 +1,223 @@
 package tinybastion
 
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/acuteaura/tinybastion/internal/policy"
+	"github.com/pkg/errors"
+)
+
+const (
+	// BackendKernel uses the wireguard kernel module
+	BackendKernel = "kernel"
+	// BackendUserspace runs wireguard-go in-process, for hosts without the kernel module
+	BackendUserspace = "userspace"
+)
+
 type Config struct {
-	DeviceName          string
+	DeviceName string
+	// Backend selects how the wireguard interface is implemented, BackendKernel if empty
+	Backend             string
 	Port                int
 	PersistentKeepalive int
 	ExternalHostname    string
-	CIDR                string
+	// CIDR is the IPv4 tunnel network, CIDR6 the IPv6 one. At least one of them must be set,
+	// with both set every peer gets an address from each.
+	CIDR  string
+	CIDR6 string
+	// Pools are further tunnel networks by name, for peers that must not share the addresses of CIDR and CIDR6,
+	// e.g. those of a certain issuer. They must not overlap with the tunnel networks or each other.
+	Pools map[string]Pool
+	// RoutedNetworks are made reachable for peers, the bastion forwards and masquerades traffic towards them
+	RoutedNetworks []string
+	// DisablePeerIsolation lets all peers reach each other through the bastion,
+	// by default only peers in the same policy peer group can
+	DisablePeerIsolation bool
+	// MaxSessionDuration caps how long a peer lives after it was created, regardless of its token's expiry.
+	// Zero leaves peers bound to the token expiry alone.
+	MaxSessionDuration time.Duration
+	// MaxPeersPerRun caps the peers a single CI job run can have at once, by the run_id and run_attempt claims
+	// of its tokens. Zero means no cap, peers of tokens without a run_id are never capped.
+	MaxPeersPerRun int
+
+	// PrivateKeyFile keeps the bastion key stable across restarts, it is created if it does not exist
+	PrivateKeyFile string
+	// StateFile persists issued peers, so they can be restored after a restart
+	StateFile string
+	// AuditLogFile is appended a hash chained record of every grant, renewal and removal of a tunnel.
+	// Tunnels are only granted once their record is written.
+	AuditLogFile string
+	// WebhookURLs are sent peer lifecycle events, signed with WebhookSecret
+	WebhookURLs   []string
+	WebhookSecret string
+}
+
+// Pool is an additional tunnel network, peers get an address from each of its networks.
+// Unlike CIDR and CIDR6, the bastion has no address in it.
+type Pool struct {
+	CIDR  string
+	CIDR6 string
+}
+
+// maxDeviceNameLength is IFNAMSIZ without the terminating zero
+const maxDeviceNameLength = 15
+
+// Validate checks the config without touching the system, all problems are reported at once
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+	switch {
+	case c.DeviceName == "":
+		problems = append(problems, "device name is required")
+	case len(c.DeviceName) > maxDeviceNameLength:
+		problems = append(problems, fmt.Sprintf("device name %s is longer than %d characters", c.DeviceName, maxDeviceNameLength))
+	case strings.ContainsAny(c.DeviceName, "/: \t\n") || c.DeviceName == "." || c.DeviceName == "..":
+		problems = append(problems, fmt.Sprintf("device name %q is not a valid interface name", c.DeviceName))
+	}
+	if c.Backend != "" && c.Backend != BackendKernel && c.Backend != BackendUserspace {
+		problems = append(problems, fmt.Sprintf("unknown backend %s, expected %s or %s", c.Backend, BackendKernel, BackendUserspace))
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %d is not between 1 and 65535", c.Port))
+	}
+	if c.PersistentKeepalive < 1 || c.PersistentKeepalive > 65535 {
+		problems = append(problems, fmt.Sprintf("persistent keepalive %d is not between 1 and 65535 seconds", c.PersistentKeepalive))
+	}
+	if _, err := c.prefixes(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := c.pools(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := c.routedNetworks(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.MaxSessionDuration < 0 {
+		problems = append(problems, fmt.Sprintf("max session duration %s is negative", c.MaxSessionDuration))
+	}
+	if c.MaxPeersPerRun < 0 {
+		problems = append(problems, fmt.Sprintf("max peers per run %d is negative", c.MaxPeersPerRun))
+	}
+	for _, webhookURL := range c.WebhookURLs {
+		u, err := url.Parse(webhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("webhook URL %s is not an absolute http(s) URL", webhookURL))
+		}
+	}
+	if len(c.WebhookURLs) > 0 && c.WebhookSecret == "" {
+		problems = append(problems, "webhooks require a secret")
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// prefixes parses the configured tunnel networks, IPv4 first
+func (c *Config) prefixes() ([]*net.IPNet, error) {
+	return parsePrefixes("", c.CIDR, c.CIDR6)
+}
+
+// pools parses the networks of all pools, it fails if any of them overlap with another or the tunnel networks
+func (c *Config) pools() (map[string][]*net.IPNet, error) {
+	pools := make(map[string][]*net.IPNet, len(c.Pools))
+	if len(c.Pools) == 0 {
+		return pools, nil
+	}
+
+	// invalid tunnel networks are reported on their own
+	taken, _ := c.prefixes()
+	names := make([]string, 0, len(c.Pools))
+	for name := range c.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "" {
+			return nil, errors.New("pool names must not be empty")
+		}
+		pool := c.Pools[name]
+		prefixes, err := parsePrefixes(fmt.Sprintf("pool %s ", name), pool.CIDR, pool.CIDR6)
+		if err != nil {
+			return nil, err
+		}
+		for _, prefix := range prefixes {
+			for _, other := range taken {
+				if prefix.Contains(other.IP) || other.Contains(prefix.IP) {
+					return nil, errors.Errorf("pool %s network %s overlaps with %s", name, prefix, other)
+				}
+			}
+		}
+		taken = append(taken, prefixes...)
+		pools[name] = prefixes
+	}
+	return pools, nil
+}
+
+// parsePrefixes parses an IPv4 and an IPv6 network, IPv4 first. At least one of them is required.
+func parsePrefixes(prefix string, cidr string, cidr6 string) ([]*net.IPNet, error) {
+	prefixes := make([]*net.IPNet, 0, 2)
+	if cidr != "" {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %sCIDR", prefix)
+		}
+		if ipnet.IP.To4() == nil {
+			return nil, errors.Errorf("%sCIDR %s is not an IPv4 network", prefix, cidr)
+		}
+		prefixes = append(prefixes, ipnet)
+	}
+	if cidr6 != "" {
+		_, ipnet, err := net.ParseCIDR(cidr6)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %sCIDR6", prefix)
+		}
+		if ipnet.IP.To4() != nil {
+			return nil, errors.Errorf("%sCIDR6 %s is not an IPv6 network", prefix, cidr6)
+		}
+		prefixes = append(prefixes, ipnet)
+	}
+	if len(prefixes) == 0 {
+		return nil, errors.Errorf("at least one of %sCIDR and CIDR6 is required", prefix)
+	}
+	return prefixes, nil
+}
+
+func (c *Config) routedNetworks() ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(c.RoutedNetworks))
+	for _, network := range c.RoutedNetworks {
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid routed network %s", network)
+		}
+		networks = append(networks, ipnet)
+	}
+	return networks, nil
+}
+
+// ValidatePolicy checks that a policy only grants networks within the routed networks
+func (c *Config) ValidatePolicy(p *policy.Policy) error {
+	routed, err := c.routedNetworks()
+	if err != nil {
+		return err
+	}
+	return p.Validate(routed)
+}
+
+// device creates the DeviceManager for the configured backend
+func (c *Config) device() (DeviceManager, error) {
+	switch c.Backend {
+	case "", BackendKernel:
+		return NewKernelDevice(c.DeviceName)
+	case BackendUserspace:
+		return NewUserspaceDevice(c.DeviceName)
+	default:
+		return nil, errors.Errorf("unknown backend %s, expected %s or %s", c.Backend, BackendKernel, BackendUserspace)
+	}
 }
@@ -0,0 +1,27 @@
+package tinybastion
+
+import (
+	"net"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DeviceManager controls the wireguard interface of a bastion. KernelDevice is the real thing,
+// MemoryDevice keeps everything in memory for tests.
+type DeviceManager interface {
+	// Create sets up a fresh, running interface. An existing interface with the same name is replaced,
+	// since we'd have to reset both wireguard state and addresses to reuse it.
+	Create() error
+	// AddAddress assigns a host address (/32 or /128) to the interface
+	AddAddress(addr net.IPNet) error
+	// AddRoute routes a network into the interface
+	AddRoute(dst *net.IPNet) error
+	// EnableForwarding turns on routing between interfaces for the address families of the given networks
+	EnableForwarding(prefixes []*net.IPNet) error
+	// Device returns the current wireguard state, including peers
+	Device() (*wgtypes.Device, error)
+	// Configure applies a wireguard configuration, like wgctrl.Client.ConfigureDevice
+	Configure(cfg wgtypes.Config) error
+	// Destroy removes the interface
+	Destroy() error
+}
@@ -0,0 +1,53 @@
+package tinybastion
+
+import (
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+var _ DeviceManager = &KernelDevice{}
+
+// KernelDevice manages a kernel wireguard interface through netlink and wgctrl, it needs CAP_NET_ADMIN.
+type KernelDevice struct {
+	linkDevice
+}
+
+func NewKernelDevice(name string) (*KernelDevice, error) {
+	ld, err := newLinkDevice(name)
+	if err != nil {
+		return nil, err
+	}
+	return &KernelDevice{linkDevice: ld}, nil
+}
+
+func (d *KernelDevice) Create() error {
+	err := d.deleteExisting()
+	if err != nil {
+		return err
+	}
+
+	// LinkAttr is used to describe the interface
+	// we just need to set a name
+	wgLinkAttr := netlink.NewLinkAttrs()
+	wgLinkAttr.Name = d.name
+
+	wgLink := &wg{
+		LinkAttrs: wgLinkAttr,
+	}
+
+	// add the interface
+	err = netlink.LinkAdd(wgLink)
+	if err != nil {
+		return errors.Wrap(err, "unable to create link")
+	}
+
+	return d.setUp()
+}
+
+func (d *KernelDevice) Destroy() error {
+	defer d.client.Close()
+	if d.link == nil {
+		return nil
+	}
+	return netlink.LinkDel(d.link)
+}
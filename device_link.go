@@ -0,0 +1,105 @@
+package tinybastion
+
+import (
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// linkDevice is what the kernel and userspace backends share, once the link exists both are
+// configured through netlink and wgctrl alike
+type linkDevice struct {
+	name   string
+	client *wgctrl.Client
+	link   netlink.Link
+}
+
+func newLinkDevice(name string) (linkDevice, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return linkDevice{}, err
+	}
+	return linkDevice{name: name, client: client}, nil
+}
+
+// deleteExisting removes a link left behind by a previous instance
+func (d *linkDevice) deleteExisting() error {
+	link, err := netlink.LinkByName(d.name)
+	if err != nil {
+		_, ok := err.(netlink.LinkNotFoundError)
+		if !ok {
+			return err
+		}
+		return nil
+	}
+
+	slog.Info("link found, re-creating", "device", d.name)
+	err = netlink.LinkDel(link)
+	if err != nil {
+		return errors.Wrap(err, "unable to delete link")
+	}
+	return nil
+}
+
+// setUp finds the freshly created link and brings it up
+func (d *linkDevice) setUp() error {
+	// re-aquire the link to get the index, LinkAdd does not write info back!
+	var err error
+	d.link, err = netlink.LinkByName(d.name)
+	if err != nil {
+		return err
+	}
+
+	// WG interfaces always show UNKNOWN, but need to be set up anyway to accept routes
+	err = netlink.LinkSetUp(d.link)
+	if err != nil {
+		return err
+	}
+
+	// ensure the interface is considered valid by wireguard
+	_, err = d.client.Device(d.name)
+	return err
+}
+
+func (d *linkDevice) AddAddress(addr net.IPNet) error {
+	return netlink.AddrAdd(d.link, &netlink.Addr{
+		IPNet: &addr,
+		// the address is ours alone, duplicate address detection would only delay IPv6 setup
+		Flags: unix.IFA_F_NODAD,
+	})
+}
+
+func (d *linkDevice) AddRoute(dst *net.IPNet) error {
+	return netlink.RouteAdd(&netlink.Route{
+		Dst:       dst,
+		LinkIndex: d.link.Attrs().Index,
+	})
+}
+
+func (d *linkDevice) EnableForwarding(prefixes []*net.IPNet) error {
+	for _, prefix := range prefixes {
+		sysctl := "/proc/sys/net/ipv4/ip_forward"
+		if prefix.IP.To4() == nil {
+			sysctl = "/proc/sys/net/ipv6/conf/all/forwarding"
+		}
+		err := os.WriteFile(sysctl, []byte("1"), 0644)
+		if err != nil {
+			return errors.Wrapf(err, "unable to write %s", sysctl)
+		}
+	}
+	return nil
+}
+
+func (d *linkDevice) Device() (*wgtypes.Device, error) {
+	return d.client.Device(d.name)
+}
+
+func (d *linkDevice) Configure(cfg wgtypes.Config) error {
+	return d.client.ConfigureDevice(d.name, cfg)
+}
@@ -0,0 +1,158 @@
+package tinybastion
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var _ DeviceManager = &MemoryDevice{}
+
+// MemoryDevice is a DeviceManager without an actual interface behind it. Peers never handshake on their own,
+// use SetLastHandshake to simulate traffic.
+type MemoryDevice struct {
+	name string
+
+	mu         sync.Mutex
+	created    bool
+	privateKey wgtypes.Key
+	listenPort int
+	peers      map[wgtypes.Key]*wgtypes.Peer
+	addresses  []net.IPNet
+	routes     []net.IPNet
+	forwarding bool
+}
+
+func NewMemoryDevice(name string) *MemoryDevice {
+	return &MemoryDevice{name: name, peers: make(map[wgtypes.Key]*wgtypes.Peer)}
+}
+
+func (d *MemoryDevice) Create() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.created = true
+	d.privateKey = wgtypes.Key{}
+	d.listenPort = 0
+	d.peers = make(map[wgtypes.Key]*wgtypes.Peer)
+	d.addresses = nil
+	d.routes = nil
+	return nil
+}
+
+func (d *MemoryDevice) AddAddress(addr net.IPNet) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.created {
+		return errors.New("device not created")
+	}
+	d.addresses = append(d.addresses, addr)
+	return nil
+}
+
+func (d *MemoryDevice) AddRoute(dst *net.IPNet) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.created {
+		return errors.New("device not created")
+	}
+	d.routes = append(d.routes, *dst)
+	return nil
+}
+
+func (d *MemoryDevice) EnableForwarding(_ []*net.IPNet) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.forwarding = true
+	return nil
+}
+
+func (d *MemoryDevice) Device() (*wgtypes.Device, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.created {
+		return nil, errors.New("device not created")
+	}
+
+	device := &wgtypes.Device{
+		Name:       d.name,
+		Type:       wgtypes.Unknown,
+		PrivateKey: d.privateKey,
+		PublicKey:  d.privateKey.PublicKey(),
+		ListenPort: d.listenPort,
+		Peers:      make([]wgtypes.Peer, 0, len(d.peers)),
+	}
+	for _, p := range d.peers {
+		peer := *p
+		peer.AllowedIPs = append([]net.IPNet{}, p.AllowedIPs...)
+		device.Peers = append(device.Peers, peer)
+	}
+	return device, nil
+}
+
+// Configure follows the semantics of wgctrl, but only for the fields the bastion uses
+func (d *MemoryDevice) Configure(cfg wgtypes.Config) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.created {
+		return errors.New("device not created")
+	}
+
+	if cfg.PrivateKey != nil {
+		d.privateKey = *cfg.PrivateKey
+	}
+	if cfg.ListenPort != nil {
+		d.listenPort = *cfg.ListenPort
+	}
+	if cfg.ReplacePeers {
+		d.peers = make(map[wgtypes.Key]*wgtypes.Peer)
+	}
+
+	for _, pc := range cfg.Peers {
+		if pc.Remove {
+			delete(d.peers, pc.PublicKey)
+			continue
+		}
+		p, ok := d.peers[pc.PublicKey]
+		if !ok {
+			if pc.UpdateOnly {
+				continue
+			}
+			p = &wgtypes.Peer{PublicKey: pc.PublicKey}
+			d.peers[pc.PublicKey] = p
+		}
+		if pc.PresharedKey != nil {
+			p.PresharedKey = *pc.PresharedKey
+		}
+		if pc.PersistentKeepaliveInterval != nil {
+			p.PersistentKeepaliveInterval = *pc.PersistentKeepaliveInterval
+		}
+		if pc.ReplaceAllowedIPs {
+			p.AllowedIPs = nil
+		}
+		p.AllowedIPs = append(p.AllowedIPs, pc.AllowedIPs...)
+	}
+	return nil
+}
+
+func (d *MemoryDevice) Destroy() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.created = false
+	d.peers = make(map[wgtypes.Key]*wgtypes.Peer)
+	return nil
+}
+
+// SetLastHandshake pretends a peer has completed a handshake at the given time
+func (d *MemoryDevice) SetLastHandshake(key wgtypes.Key, t time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.peers[key]
+	if !ok {
+		return ErrPeerNotFound
+	}
+	p.LastHandshakeTime = t
+	return nil
+}
@@ -0,0 +1,120 @@
+package tinybastion
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+var _ DeviceManager = &UserspaceDevice{}
+
+// UserspaceDevice runs wireguard-go in-process on a TUN interface, for hosts without the kernel module.
+// It serves the usual UAPI socket, so wgctrl (and wg(8)) manage it just like a kernel interface.
+// Creating the TUN interface still needs CAP_NET_ADMIN.
+type UserspaceDevice struct {
+	linkDevice
+
+	device *device.Device
+	uapi   net.Listener
+}
+
+func NewUserspaceDevice(name string) (*UserspaceDevice, error) {
+	ld, err := newLinkDevice(name)
+	if err != nil {
+		return nil, err
+	}
+	return &UserspaceDevice{linkDevice: ld}, nil
+}
+
+func (d *UserspaceDevice) Create() error {
+	d.close()
+	err := d.deleteExisting()
+	if err != nil {
+		return err
+	}
+
+	tunDevice, err := tun.CreateTUN(d.name, device.DefaultMTU)
+	if err != nil {
+		return errors.Wrap(err, "unable to create tun device")
+	}
+
+	d.device = device.NewDevice(tunDevice, conn.NewDefaultBind(), deviceLogger(d.name))
+
+	uapiFile, err := ipc.UAPIOpen(d.name)
+	if err != nil {
+		d.close()
+		return errors.Wrap(err, "unable to open uapi socket")
+	}
+	d.uapi, err = ipc.UAPIListen(d.name, uapiFile)
+	if err != nil {
+		uapiFile.Close()
+		d.close()
+		return errors.Wrap(err, "unable to listen on uapi socket")
+	}
+	go d.serveUAPI(d.device, d.uapi)
+
+	err = d.setUp()
+	if err != nil {
+		d.close()
+		return err
+	}
+
+	// the device would come up on the tun event as well, but peers are configured right after this
+	return d.device.Up()
+}
+
+// deviceLogger forwards wireguard-go logs to slog, its verbose output is only shown at debug level
+func deviceLogger(name string) *device.Logger {
+	return &device.Logger{
+		Verbosef: func(format string, args ...any) {
+			slog.Debug(fmt.Sprintf(format, args...), "device", name)
+		},
+		Errorf: func(format string, args ...any) {
+			slog.Error(fmt.Sprintf(format, args...), "device", name)
+		},
+	}
+}
+
+// serveUAPI answers wgctrl requests until the listener is closed
+func (d *UserspaceDevice) serveUAPI(dev *device.Device, listener net.Listener) {
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go dev.IpcHandle(c)
+	}
+}
+
+func (d *UserspaceDevice) Destroy() error {
+	d.close()
+	return d.client.Close()
+}
+
+// close stops wireguard-go, closing the tun device also removes the link
+func (d *UserspaceDevice) close() {
+	if d.uapi != nil {
+		err := d.uapi.Close()
+		if err != nil {
+			slog.Error("unable to close uapi socket", "device", d.name, "error", err)
+		}
+		// the listener leaves its socket file behind, which would show up as a stale device in wg(8)
+		err = os.Remove(fmt.Sprintf("/var/run/wireguard/%s.sock", d.name))
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error("unable to remove uapi socket", "device", d.name, "error", err)
+		}
+		d.uapi = nil
+	}
+	if d.device != nil {
+		d.device.Close()
+		d.device = nil
+	}
+	d.link = nil
+}
@@ -4,26 +4,65 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/acuteaura/tinybastion/internal/logging"
 	"github.com/acuteaura/tinybastion/internal/oidc"
+	"github.com/acuteaura/tinybastion/internal/policy"
+	"github.com/acuteaura/tinybastion/internal/replay"
 	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/metal-stack/go-ipam"
+	"github.com/pkg/errors"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
 )
 
 type CreateTunnelRequest struct {
 	PublicKey *MarshallableKey `json:"public_key"`
+	// RotatePSK replaces the PSK if the tunnel already exists, otherwise it is returned unchanged
+	RotatePSK bool `json:"rotate_psk,omitempty"`
 }
 
 type CreateTunnelResponse struct {
 	PeerConfig *MarshallablePeerConfig
+	// Expires is zero if the peer never expires, otherwise it must be renewed before
+	Expires time.Time
 }
 
-func NewServer(ctx context.Context, tb *Bastion, listenPort int, issuer string) *Server {
-	s := &Server{}
+type DeleteTunnelRequest struct {
+	PublicKey *MarshallableKey `json:"public_key"`
+}
+
+type RenewTunnelRequest struct {
+	PublicKey *MarshallableKey `json:"public_key"`
+}
+
+type RenewTunnelResponse struct {
+	// Expires is zero if the peer never expires
+	Expires time.Time `json:"expires"`
+}
+
+// Issuer is a trusted OIDC issuer along with how its tokens are authorized
+type Issuer struct {
+	// URL must match the iss claim of its tokens exactly
+	URL string
+	// Audience is required in the aud claim of its tokens, so tokens minted for other services are rejected.
+	// Any audience is accepted if empty.
+	Audience string
+	Policy   *policy.Policy
+	// Pool names the Config.Pools entry its peers get addresses from, the tunnel networks if empty
+	Pool string
+}
 
-	s.tb = tb
+func NewServer(ctx context.Context, tb *Bastion, listenPort int, issuers []Issuer) *Server {
+	provider := oidc.NewProvider()
+	s := newServer(tb, provider, issuers)
+	go provider.KeepWarm(ctx, oidc.RefreshInterval, s.issuerURLs)
 
 	s.listener = &http.Server{
 		Addr:    fmt.Sprintf(":%d", listenPort),
@@ -33,26 +72,92 @@ func NewServer(ctx context.Context, tb *Bastion, listenPort int, issuer string)
 		},
 	}
 
-	s.oidcProider = oidc.NewProvider()
-
-	s.oidcIssuer = issuer
-
 	go func() {
-		log.Default().Printf("Starting server at port %d", listenPort)
+		slog.Info("starting server", "port", listenPort)
 		err := s.listener.ListenAndServe()
-		if err != nil {
-			log.Default().Fatalf("http server error: %s", err)
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("http server error", "error", err)
+			os.Exit(1)
 		}
 	}()
 
 	return s
 }
 
+// replayStoreSize bounds the tokens remembered for replay protection. Tokens are valid for minutes,
+// so this is far more than are in use at once.
+const replayStoreSize = 100000
+
+// newServer creates a handler without listening, so it can be driven by httptest
+func newServer(tb *Bastion, provider oidc.ProviderInterface, issuers []Issuer) *Server {
+	s := &Server{
+		tb:          tb,
+		oidcProider: provider,
+		replay:      replay.New(replayStoreSize),
+	}
+	s.Reload(issuers)
+	return s
+}
+
 type Server struct {
 	listener    *http.Server
 	tb          *Bastion
 	oidcProider oidc.ProviderInterface
-	oidcIssuer  string
+	// replay binds every token to the first public key it creates a tunnel for
+	replay *replay.Store
+
+	// issuersMu guards what Reload replaces
+	issuersMu sync.RWMutex
+	// issuers are keyed by URL
+	issuers map[string]Issuer
+}
+
+// Reload replaces the trusted issuers, requests already past authentication finish with the old ones
+func (s *Server) Reload(issuers []Issuer) {
+	byURL := make(map[string]Issuer, len(issuers))
+	for _, issuer := range issuers {
+		byURL[issuer.URL] = issuer
+	}
+
+	s.issuersMu.Lock()
+	defer s.issuersMu.Unlock()
+	s.issuers = byURL
+}
+
+// issuerURLs returns the URLs of the trusted issuers
+func (s *Server) issuerURLs() []string {
+	s.issuersMu.RLock()
+	defer s.issuersMu.RUnlock()
+
+	urls := make([]string, 0, len(s.issuers))
+	for url := range s.issuers {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// issuerFor picks the issuer to verify a token against by its unverified iss claim
+func (s *Server) issuerFor(tokenStr string) (Issuer, error) {
+	s.issuersMu.RLock()
+	defer s.issuersMu.RUnlock()
+
+	if len(s.issuers) == 1 {
+		// nothing to choose from, verification rejects tokens of other issuers
+		for _, issuer := range s.issuers {
+			return issuer, nil
+		}
+	}
+
+	iss, err := oidc.UnverifiedIssuer(tokenStr)
+	if err != nil {
+		return Issuer{}, err
+	}
+	issuer, ok := s.issuers[iss]
+	if !ok {
+		return Issuer{}, errors.Errorf("untrusted issuer %s", iss)
+	}
+	return issuer, nil
 }
 
 func (s *Server) Destroy() error {
@@ -60,63 +165,156 @@ func (s *Server) Destroy() error {
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveWithRequestID(w, r, s.route)
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/renew" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			httpError(r.Context(), w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+			return
+		}
+		s.renewTunnel(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		s.createTunnel(w, r)
+	case http.MethodDelete:
+		s.deleteTunnel(w, r)
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		httpError(r.Context(), w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+	}
+}
+
+// authenticate reads the JSON body and verifies the token of a request against its issuer,
+// it writes an error response and returns a nil token if either fails.
+// The returned context logs the subject and repository of the token.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (context.Context, []byte, jwt.Token, Issuer) {
+	ctx := r.Context()
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return ctx, nil, nil, Issuer{}
 	}
 
 	if r.Header.Get("Content-Type") != "application/json" {
-		httpError(w, http.StatusBadRequest, "bad content type")
-		return
+		httpError(ctx, w, http.StatusBadRequest, "bad content type")
+		return ctx, nil, nil, Issuer{}
 	}
 
 	tokenStr, err := oidc.DetectJWT(r)
 	if err != nil {
-		httpError(w, http.StatusUnauthorized, "no token supplied")
-		return
+		httpError(ctx, w, http.StatusUnauthorized, "no token supplied")
+		return ctx, nil, nil, Issuer{}
 	}
 
-	verifiedToken, err := s.oidcProider.VerifyToken(tokenStr, s.oidcIssuer)
+	issuer, err := s.issuerFor(tokenStr)
 	if err != nil {
-		httpError(w, http.StatusForbidden, fmt.Sprintf("bad token: %v", err))
-		return
+		httpError(ctx, w, http.StatusForbidden, fmt.Sprintf("bad token: %v", err))
+		return ctx, nil, nil, Issuer{}
+	}
+	verifiedToken, err := s.oidcProider.VerifyToken(ctx, tokenStr, issuer.URL, issuer.Audience)
+	if err != nil {
+		httpError(ctx, w, http.StatusForbidden, fmt.Sprintf("bad token: %v", err))
+		return ctx, nil, nil, Issuer{}
 	}
 
-	repositoryOwnerClaim, ok := verifiedToken.Get("repository_owner")
-	if !ok {
-		httpError(w, http.StatusForbidden, "repository_owner claim missing")
+	fields := []any{"sub", verifiedToken.Subject(), "iss", verifiedToken.Issuer()}
+	if repository, ok := verifiedToken.Get("repository"); ok {
+		fields = append(fields, "repository", repository)
+	}
+	return logging.With(ctx, fields...), body, verifiedToken, issuer
+}
+
+func (s *Server) createTunnel(w http.ResponseWriter, r *http.Request) {
+	outcome := outcomeError
+	defer func() {
+		tunnelCreateRequests.Inc(outcome)
+	}()
+
+	ctx, body, verifiedToken, issuer := s.authenticate(w, r)
+	if verifiedToken == nil {
+		outcome = outcomeAuthFailure
 		return
 	}
 
-	repositoryOwner, ok := repositoryOwnerClaim.(string)
-	if !ok {
-		httpError(w, http.StatusInternalServerError, "claim conversion fault")
+	claims, err := verifiedToken.AsMap(ctx)
+	if err != nil {
+		httpError(ctx, w, http.StatusInternalServerError, "claim conversion fault")
 		return
 	}
 
-	// TODO: parameterize
-	if repositoryOwner != "acuteaura" {
-		httpError(w, http.StatusForbidden, fmt.Sprintf("unexpected github org: %s", repositoryOwner))
+	decision := issuer.Policy.Evaluate(claims)
+	if !decision.Allowed {
+		outcome = outcomePolicyDenied
+		s.tb.AuditDenied(ctx, identityFromToken(verifiedToken), claims)
+		httpError(ctx, w, http.StatusForbidden, fmt.Sprintf("denied by policy: sub=%s", verifiedToken.Subject()))
 		return
 	}
+	logging.FromContext(ctx).Info("allowed by policy", "rule", decision.Rule)
 
 	req := CreateTunnelRequest{}
 	err = json.Unmarshal(body, &req)
 
 	if err != nil {
-		httpError(w, http.StatusBadRequest, "cannot unmarshal json")
+		outcome = outcomeBadRequest
+		httpError(ctx, w, http.StatusBadRequest, "cannot unmarshal json")
 		return
 	}
 
 	if req.PublicKey == nil {
-		httpError(w, http.StatusBadRequest, "empty public key")
+		outcome = outcomeBadRequest
+		httpError(ctx, w, http.StatusBadRequest, "empty public key")
 		return
 	}
 
-	peerConfig, err := s.tb.AddPeer(req.PublicKey.K)
+	// a leaked token can't be used to open further tunnels, only to retry the first one
+	id, err := tokenID(verifiedToken)
+	if err != nil {
+		httpError(ctx, w, http.StatusInternalServerError, fmt.Sprintf("unable to identify token: %s", err))
+		return
+	}
+	err = s.replay.Use(id, req.PublicKey.K.String(), verifiedToken.Expiration())
+	if errors.Is(err, replay.ErrReplayed) {
+		outcome = outcomeReplayed
+		httpError(ctx, w, http.StatusForbidden, fmt.Sprintf("token of sub=%s was already used for another tunnel", verifiedToken.Subject()))
+		return
+	}
+	if err != nil {
+		httpError(ctx, w, http.StatusServiceUnavailable, fmt.Sprintf("replay protection failed: %s", err))
+		return
+	}
+
+	peerConfig, err := s.tb.AddPeer(ctx, req.PublicKey.K, PeerOptions{
+		Owner:     identityFromToken(verifiedToken),
+		Claims:    claims,
+		Grants:    decision.Grants,
+		PeerGroup: decision.PeerGroup,
+		Expiry:    verifiedToken.Expiration(),
+		RotatePSK: req.RotatePSK,
+		Pool:      issuer.Pool,
+	})
+	if errors.Is(err, ErrPeerOwnerMismatch) {
+		outcome = outcomeConflict
+		httpError(ctx, w, http.StatusConflict, fmt.Sprintf("peer %s is already registered to another identity than sub=%s", req.PublicKey.K, verifiedToken.Subject()))
+		return
+	}
+	if errors.Is(err, ErrRunPeerLimit) {
+		outcome = outcomeRunLimit
+		httpError(ctx, w, http.StatusTooManyRequests, fmt.Sprintf("addpeer failed: %s", err))
+		return
+	}
+	if errors.Is(err, ipam.ErrNoIPAvailable) {
+		outcome = outcomeIPAMExhausted
+		httpError(ctx, w, http.StatusServiceUnavailable, fmt.Sprintf("addpeer failed: %s", err))
+		return
+	}
 	if err != nil {
-		httpError(w, http.StatusInternalServerError, fmt.Sprintf("addpeer failed: %s", err))
+		httpError(ctx, w, http.StatusInternalServerError, fmt.Sprintf("addpeer failed: %s", err))
 		return
 	}
 
@@ -125,11 +323,113 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		BSI: s.tb.ServerInfo(),
 	}
 
-	res := CreateTunnelResponse{mpc}
+	expires, err := s.tb.PeerExpiry(req.PublicKey.K)
+	if err != nil {
+		// removed again in the meantime
+		httpError(ctx, w, http.StatusInternalServerError, fmt.Sprintf("peer expiry lookup failed: %s", err))
+		return
+	}
+
+	res := CreateTunnelResponse{PeerConfig: mpc, Expires: expires}
 
 	data, err := json.Marshal(&res)
 	if err != nil {
-		httpError(w, http.StatusInternalServerError, "cannot marshall response json")
+		httpError(ctx, w, http.StatusInternalServerError, "cannot marshall response json")
+		return
+	}
+
+	outcome = outcomeSuccess
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+func (s *Server) deleteTunnel(w http.ResponseWriter, r *http.Request) {
+	ctx, body, verifiedToken, _ := s.authenticate(w, r)
+	if verifiedToken == nil {
+		return
+	}
+
+	// no policy check here, a job must always be able to clean up after itself
+	req := DeleteTunnelRequest{}
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		httpError(ctx, w, http.StatusBadRequest, "cannot unmarshal json")
+		return
+	}
+
+	if req.PublicKey == nil {
+		httpError(ctx, w, http.StatusBadRequest, "empty public key")
+		return
+	}
+
+	err = s.tb.RemoveOwnedPeer(ctx, req.PublicKey.K, identityFromToken(verifiedToken))
+	switch {
+	case errors.Is(err, ErrPeerNotFound):
+		httpError(ctx, w, http.StatusNotFound, fmt.Sprintf("no peer %s", req.PublicKey.K))
+		return
+	case errors.Is(err, ErrPeerOwnerMismatch):
+		httpError(ctx, w, http.StatusForbidden, fmt.Sprintf("sub=%s does not own peer %s", verifiedToken.Subject(), req.PublicKey.K))
+		return
+	case err != nil:
+		httpError(ctx, w, http.StatusInternalServerError, fmt.Sprintf("removepeer failed: %s", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) renewTunnel(w http.ResponseWriter, r *http.Request) {
+	ctx, body, verifiedToken, issuer := s.authenticate(w, r)
+	if verifiedToken == nil {
+		return
+	}
+
+	claims, err := verifiedToken.AsMap(ctx)
+	if err != nil {
+		httpError(ctx, w, http.StatusInternalServerError, "claim conversion fault")
+		return
+	}
+
+	// the policy may have changed since the peer was created
+	decision := issuer.Policy.Evaluate(claims)
+	if !decision.Allowed {
+		s.tb.AuditDenied(ctx, identityFromToken(verifiedToken), claims)
+		httpError(ctx, w, http.StatusForbidden, fmt.Sprintf("denied by policy: sub=%s", verifiedToken.Subject()))
+		return
+	}
+
+	req := RenewTunnelRequest{}
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		httpError(ctx, w, http.StatusBadRequest, "cannot unmarshal json")
+		return
+	}
+
+	if req.PublicKey == nil {
+		httpError(ctx, w, http.StatusBadRequest, "empty public key")
+		return
+	}
+
+	expires, err := s.tb.RenewPeer(ctx, req.PublicKey.K, identityFromToken(verifiedToken), verifiedToken.Expiration())
+	switch {
+	case errors.Is(err, ErrPeerNotFound):
+		httpError(ctx, w, http.StatusNotFound, fmt.Sprintf("no peer %s", req.PublicKey.K))
+		return
+	case errors.Is(err, ErrPeerOwnerMismatch):
+		httpError(ctx, w, http.StatusForbidden, fmt.Sprintf("sub=%s does not own peer %s", verifiedToken.Subject(), req.PublicKey.K))
+		return
+	case errors.Is(err, ErrPeerExpired):
+		httpError(ctx, w, http.StatusGone, fmt.Sprintf("peer %s has expired", req.PublicKey.K))
+		return
+	case err != nil:
+		httpError(ctx, w, http.StatusInternalServerError, fmt.Sprintf("renewpeer failed: %s", err))
+		return
+	}
+
+	data, err := json.Marshal(&RenewTunnelResponse{Expires: expires})
+	if err != nil {
+		httpError(ctx, w, http.StatusInternalServerError, "cannot marshall response json")
 		return
 	}
 
@@ -138,11 +438,44 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-func httpError(w http.ResponseWriter, statusCode int, message string) {
-	// generate a uuid so we can search for failures in logs
-	eid := uuid.New()
-	w.Header().Add("X-Error-ID", eid.String())
+// statusRecorder remembers the status of a response for the request log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(statusCode int) {
+	sr.status = statusCode
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+// serveWithRequestID assigns every request an ID, which is returned as X-Request-ID
+// and attached to everything logged while handling it
+func serveWithRequestID(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
+	start := time.Now()
+	requestID := uuid.New().String()
+	ctx := logging.WithRequestID(r.Context(), requestID)
+	w.Header().Set("X-Request-ID", requestID)
+
+	sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	handler(sr, r.WithContext(ctx))
+
+	logging.FromContext(ctx).Info("request handled", "method", r.Method, "path", r.URL.Path, "status", sr.status, "duration", time.Since(start))
+}
+
+func httpError(ctx context.Context, w http.ResponseWriter, statusCode int, message string) {
+	// the request ID lets us search for failures in logs
+	eid := logging.RequestID(ctx)
+	if eid == "" {
+		eid = uuid.New().String()
+	}
+	w.Header().Add("X-Error-ID", eid)
 	w.WriteHeader(statusCode)
-	w.Write([]byte(eid.String()))
-	log.Default().Printf("[%s] http %d: %s", eid.String(), statusCode, message)
+	w.Write([]byte(eid))
+
+	level := slog.LevelWarn
+	if statusCode >= 500 {
+		level = slog.LevelError
+	}
+	logging.FromContext(ctx).Log(ctx, level, message, "status", statusCode)
 }
@@ -0,0 +1,381 @@
+package tinybastion
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/acuteaura/tinybastion/internal/logging"
+	"github.com/acuteaura/tinybastion/internal/policy"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeProvider accepts the tokens it knows by their literal string
+type fakeProvider struct {
+	tokens map[string]jwt.Token
+}
+
+func (f *fakeProvider) VerifyToken(_ context.Context, tokenString string, issuer string, audience string, _ ...jwt.ParseOption) (jwt.Token, error) {
+	token, ok := f.tokens[tokenString]
+	if !ok || token.Issuer() != issuer || (audience != "" && !slices.Contains(token.Audience(), audience)) {
+		return nil, errors.New("invalid token")
+	}
+	return token, nil
+}
+
+func newTestToken(t *testing.T, subject string, claims map[string]interface{}) jwt.Token {
+	token := jwt.New()
+	require.NoError(t, token.Set(jwt.IssuerKey, testIdentity.Issuer))
+	require.NoError(t, token.Set(jwt.SubjectKey, subject))
+	for k, v := range claims {
+		require.NoError(t, token.Set(k, v))
+	}
+	return token
+}
+
+func newTestServer(t *testing.T) (*Server, *MemoryDevice) {
+	b, device := newTestBastion(t, "10.0.0.0/29")
+
+	pol, err := policy.Parse([]byte(`{"rules": [{"name": "owner", "match": {"claim": "repository_owner", "exact": "acuteaura"}}]}`))
+	require.NoError(t, err)
+
+	provider := &fakeProvider{tokens: map[string]jwt.Token{
+		"allowed": newTestToken(t, testIdentity.Subject, map[string]interface{}{"repository_owner": "acuteaura"}),
+		"other":   newTestToken(t, "repo:acuteaura/other:ref:refs/heads/main", map[string]interface{}{"repository_owner": "acuteaura"}),
+		"denied":  newTestToken(t, "repo:someone/else:ref:refs/heads/main", map[string]interface{}{"repository_owner": "someone"}),
+	}}
+
+	return newServer(b, provider, []Issuer{{URL: testIdentity.Issuer, Policy: pol}}), device
+}
+
+func doTestRequest(t *testing.T, s *Server, method string, token string, key wgtypes.Key) *httptest.ResponseRecorder {
+	return doTestRequestPath(t, s, method, "/", token, key)
+}
+
+func doTestRequestPath(t *testing.T, s *Server, method string, path string, token string, key wgtypes.Key) *httptest.ResponseRecorder {
+	body, err := json.Marshal(CreateTunnelRequest{PublicKey: &MarshallableKey{K: key}})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServer_CreateTunnel(t *testing.T) {
+	s, device := newTestServer(t)
+	key := generateKey(t)
+
+	rec := doTestRequest(t, s, http.MethodPost, "allowed", key)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var res CreateTunnelResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	require.Len(t, res.PeerConfig.P.AllowedIPs, 1)
+	assert.Equal(t, "10.0.0.2/32", res.PeerConfig.P.AllowedIPs[0].String())
+	assert.Equal(t, []string{"10.0.0.1"}, res.PeerConfig.BSI.GatewayIPs)
+
+	peers := devicePeers(t, device)
+	require.Contains(t, peers, key)
+	assert.Equal(t, *res.PeerConfig.P.PresharedKey, peers[key].PresharedKey)
+}
+
+func TestServer_CreateTunnelConflict(t *testing.T) {
+	s, device := newTestServer(t)
+	key := generateKey(t)
+
+	rec := doTestRequest(t, s, http.MethodPost, "allowed", key)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var first CreateTunnelResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &first))
+
+	rec = doTestRequest(t, s, http.MethodPost, "allowed", key)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var retried CreateTunnelResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &retried))
+	assert.Equal(t, first.PeerConfig.P.AllowedIPs, retried.PeerConfig.P.AllowedIPs)
+	assert.Equal(t, first.PeerConfig.P.PresharedKey, retried.PeerConfig.P.PresharedKey)
+
+	rec = doTestRequest(t, s, http.MethodPost, "other", key)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Len(t, devicePeers(t, device), 1)
+}
+
+func TestServer_CreateTunnelUnauthorized(t *testing.T) {
+	s, device := newTestServer(t)
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusForbidden},
+		{"bad token", "forged", http.StatusForbidden},
+		{"denied by policy", "denied", http.StatusForbidden},
+	}
+	authFailures := tunnelCreateRequests.Value(outcomeAuthFailure)
+	policyDenials := tunnelCreateRequests.Value(outcomePolicyDenied)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doTestRequest(t, s, http.MethodPost, tt.token, generateKey(t))
+			assert.Equal(t, tt.want, rec.Code)
+			assert.NotEmpty(t, rec.Header().Get("X-Error-ID"))
+		})
+	}
+	assert.Empty(t, devicePeers(t, device))
+	assert.Equal(t, authFailures+2, tunnelCreateRequests.Value(outcomeAuthFailure))
+	assert.Equal(t, policyDenials+1, tunnelCreateRequests.Value(outcomePolicyDenied))
+}
+
+func TestServer_DeleteTunnel(t *testing.T) {
+	s, device := newTestServer(t)
+	key := generateKey(t)
+
+	rec := doTestRequest(t, s, http.MethodPost, "allowed", key)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = doTestRequest(t, s, http.MethodDelete, "other", key)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, devicePeers(t, device), key)
+
+	rec = doTestRequest(t, s, http.MethodDelete, "allowed", key)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, devicePeers(t, device))
+
+	rec = doTestRequest(t, s, http.MethodDelete, "allowed", key)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestServer_OwnershipPerRun(t *testing.T) {
+	s, device := newTestServer(t)
+	tokens := s.oidcProider.(*fakeProvider).tokens
+	// concurrent jobs of the same repository and ref share their subject
+	tokens["run1"] = newTestToken(t, testIdentity.Subject, map[string]interface{}{"repository_owner": "acuteaura", "run_id": "1", "run_attempt": "1"})
+	tokens["run2"] = newTestToken(t, testIdentity.Subject, map[string]interface{}{"repository_owner": "acuteaura", "run_id": "2", "run_attempt": "1"})
+	key := generateKey(t)
+
+	rec := doTestRequest(t, s, http.MethodPost, "run1", key)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = doTestRequest(t, s, http.MethodPost, "run2", key)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = doTestRequestPath(t, s, http.MethodPost, "/renew", "run2", key)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doTestRequest(t, s, http.MethodDelete, "run2", key)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, devicePeers(t, device), key)
+
+	rec = doTestRequest(t, s, http.MethodDelete, "run1", key)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+}
+
+func TestServer_CreateTunnelReplay(t *testing.T) {
+	s, device := newTestServer(t)
+	key := generateKey(t)
+
+	rec := doTestRequest(t, s, http.MethodPost, "allowed", key)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = doTestRequest(t, s, http.MethodPost, "allowed", key)
+	assert.Equal(t, http.StatusOK, rec.Code, "retries with the same token are fine")
+
+	rec = doTestRequest(t, s, http.MethodPost, "allowed", generateKey(t))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Len(t, devicePeers(t, device), 1)
+
+	// deleting the tunnel doesn't free the token either
+	rec = doTestRequest(t, s, http.MethodDelete, "allowed", key)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	rec = doTestRequest(t, s, http.MethodPost, "allowed", generateKey(t))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestServer_MethodNotAllowed(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	rec := doTestRequest(t, s, http.MethodGet, "allowed", generateKey(t))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "POST, DELETE", rec.Header().Get("Allow"))
+}
+
+func TestServer_RenewTunnel(t *testing.T) {
+	s, _ := newTestServer(t)
+	key := generateKey(t)
+
+	rec := doTestRequest(t, s, http.MethodPost, "allowed", key)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var created CreateTunnelResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	renewal := newTestToken(t, testIdentity.Subject, map[string]interface{}{"repository_owner": "acuteaura"})
+	require.NoError(t, renewal.Set(jwt.ExpirationKey, expiry))
+	s.oidcProider.(*fakeProvider).tokens["renewal"] = renewal
+
+	rec = doTestRequestPath(t, s, http.MethodPost, "/renew", "renewal", key)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var renewed RenewTunnelResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &renewed))
+	assert.True(t, expiry.Equal(renewed.Expires))
+
+	// the tunnel itself stays the same
+	pc := s.tb.peers[key]
+	assert.Equal(t, *created.PeerConfig.P.PresharedKey, pc.psk)
+	assert.Equal(t, created.PeerConfig.P.AllowedIPs[0].IP.String(), pc.ips[0].IP.String())
+
+	rec = doTestRequestPath(t, s, http.MethodPost, "/renew", "other", key)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = doTestRequestPath(t, s, http.MethodPost, "/renew", "denied", key)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = doTestRequestPath(t, s, http.MethodPost, "/renew", "allowed", generateKey(t))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = doTestRequestPath(t, s, http.MethodDelete, "/renew", "allowed", key)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "POST", rec.Header().Get("Allow"))
+}
+
+func TestServer_Reload(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	rec := doTestRequest(t, s, http.MethodPost, "allowed", generateKey(t))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	pol, err := policy.Parse([]byte(`{"rules": [{"name": "someone", "match": {"claim": "repository_owner", "exact": "someone"}}]}`))
+	require.NoError(t, err)
+	s.Reload([]Issuer{{URL: testIdentity.Issuer, Policy: pol}})
+
+	rec = doTestRequest(t, s, http.MethodPost, "allowed", generateKey(t))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doTestRequest(t, s, http.MethodPost, "denied", generateKey(t))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// tokens of other issuers are rejected
+	s.Reload([]Issuer{{URL: "https://other.example", Policy: pol}})
+	rec = doTestRequest(t, s, http.MethodPost, "denied", generateKey(t))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestServer_MultipleIssuers(t *testing.T) {
+	const gitlabIssuer = "https://gitlab.example.com"
+	device := NewMemoryDevice("test")
+	b, err := NewWithDevice(Config{
+		DeviceName:           "test",
+		PersistentKeepalive:  30,
+		CIDR:                 "10.0.0.0/29",
+		Pools:                map[string]Pool{"gitlab": {CIDR: "10.0.1.0/29"}},
+		DisablePeerIsolation: true,
+	}, device, nil)
+	require.NoError(t, err)
+	assert.Contains(t, device.routes, net.IPNet{IP: net.IP{10, 0, 1, 0}, Mask: net.CIDRMask(29, 32)})
+
+	githubPolicy, err := policy.Parse([]byte(`{"rules": [{"name": "owner", "match": {"claim": "repository_owner", "exact": "acuteaura"}}]}`))
+	require.NoError(t, err)
+	gitlabPolicy, err := policy.Parse([]byte(`{"rules": [{"name": "infra", "match": {"claim": "namespace_path", "exact": "infra"}}]}`))
+	require.NoError(t, err)
+
+	// the issuer is picked by the unverified iss claim, so these need to be actual JWTs
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	provider := &fakeProvider{tokens: map[string]jwt.Token{}}
+	signedToken := func(issuer string, subject string, claims map[string]interface{}) string {
+		token := newTestToken(t, subject, claims)
+		require.NoError(t, token.Set(jwt.IssuerKey, issuer))
+		signed, err := jwt.Sign(token, jwa.RS256, signingKey)
+		require.NoError(t, err)
+		provider.tokens[string(signed)] = token
+		return string(signed)
+	}
+	github := signedToken(testIdentity.Issuer, testIdentity.Subject, map[string]interface{}{"repository_owner": "acuteaura"})
+	gitlab := signedToken(gitlabIssuer, "project_path:infra/deploy:ref_type:branch:ref:main", map[string]interface{}{"namespace_path": "infra", "aud": "https://bastion.example.com"})
+	gitlabOtherAudience := signedToken(gitlabIssuer, "project_path:infra/deploy:ref_type:branch:ref:main", map[string]interface{}{"namespace_path": "infra", "aud": "https://vault.example.com"})
+	// allowed by the GitHub policy, but that doesn't apply to GitLab tokens
+	gitlabDenied := signedToken(gitlabIssuer, "project_path:acuteaura/deploy:ref_type:branch:ref:main", map[string]interface{}{"repository_owner": "acuteaura", "aud": "https://bastion.example.com"})
+	untrusted := signedToken("https://ci.example", testIdentity.Subject, map[string]interface{}{"repository_owner": "acuteaura"})
+
+	s := newServer(b, provider, []Issuer{
+		{URL: testIdentity.Issuer, Policy: githubPolicy},
+		{URL: gitlabIssuer, Audience: "https://bastion.example.com", Policy: gitlabPolicy, Pool: "gitlab"},
+	})
+
+	rec := doTestRequest(t, s, http.MethodPost, github, generateKey(t))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var res CreateTunnelResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, "10.0.0.2/32", res.PeerConfig.P.AllowedIPs[0].String())
+
+	key := generateKey(t)
+	rec = doTestRequest(t, s, http.MethodPost, gitlab, key)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, "10.0.1.1/32", res.PeerConfig.P.AllowedIPs[0].String())
+	// still reached through the gateway of the tunnel network
+	assert.Equal(t, []string{"10.0.0.1"}, res.PeerConfig.BSI.GatewayIPs)
+	info, err := b.Peer(key)
+	require.NoError(t, err)
+	assert.Equal(t, "gitlab", info.Pool)
+
+	rec = doTestRequest(t, s, http.MethodPost, gitlabOtherAudience, generateKey(t))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doTestRequest(t, s, http.MethodPost, gitlabDenied, generateKey(t))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doTestRequest(t, s, http.MethodPost, untrusted, generateKey(t))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doTestRequest(t, s, http.MethodPost, "garbage", generateKey(t))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestServer_RequestID(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	logs := &bytes.Buffer{}
+	defaultLogger := slog.Default()
+	slog.SetDefault(logging.New(logs, slog.LevelInfo))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	s.oidcProider.(*fakeProvider).tokens["denied"].Set("repository", "someone/else")
+	rec := doTestRequest(t, s, http.MethodPost, "denied", generateKey(t))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	requestID := rec.Header().Get("X-Request-ID")
+	require.NotEmpty(t, requestID)
+	assert.Equal(t, requestID, rec.Header().Get("X-Error-ID"))
+	assert.Equal(t, requestID, rec.Body.String())
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var denied, handled map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &denied))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &handled))
+
+	assert.Equal(t, "WARN", denied["level"])
+	assert.Equal(t, requestID, denied["request_id"])
+	assert.Equal(t, "repo:someone/else:ref:refs/heads/main", denied["sub"])
+	assert.Equal(t, "someone/else", denied["repository"])
+
+	assert.Equal(t, "request handled", handled["msg"])
+	assert.Equal(t, requestID, handled["request_id"])
+	assert.Equal(t, float64(http.StatusForbidden), handled["status"])
+}
@@ -0,0 +1,66 @@
+package tinybastion
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/acuteaura/tinybastion/internal/policy"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+// Identity is the verified subject a peer was issued to
+type Identity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	// Run is the CI job run of the token, see runOf. Subjects like GitHub's are shared by every job
+	// of a repository and ref, so without it concurrent jobs would own each other's peers.
+	Run string `json:"run,omitempty"`
+}
+
+func identityFromToken(token jwt.Token) Identity {
+	return Identity{
+		Issuer:  token.Issuer(),
+		Subject: token.Subject(),
+		Run:     runOf(token.PrivateClaims()),
+	}
+}
+
+// runOf identifies the CI job run a token was issued to as run_id/run_attempt, empty if it has no run_id claim
+func runOf(claims map[string]interface{}) string {
+	runID := claimString(claims, "run_id")
+	if runID == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s", runID, claimString(claims, "run_attempt"))
+}
+
+// claimString formats a claim for logs and events, JSON numbers are written out in full
+func claimString(claims map[string]interface{}, name string) string {
+	value, ok := claims[name]
+	if !ok || value == nil {
+		return ""
+	}
+	return policy.ClaimString(value)
+}
+
+// tokenID identifies a token by its issuer and jti, or by a hash of its claims if it has no jti
+func tokenID(token jwt.Token) (string, error) {
+	if jti := token.JwtID(); jti != "" {
+		return token.Issuer() + " " + jti, nil
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return token.Issuer() + " " + hex.EncodeToString(sum[:]), nil
+}
+
+func (i Identity) String() string {
+	if i.Run != "" {
+		return fmt.Sprintf("%s@%s run %s", i.Subject, i.Issuer, i.Run)
+	}
+	return fmt.Sprintf("%s@%s", i.Subject, i.Issuer)
+}
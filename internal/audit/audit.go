@@ -0,0 +1,232 @@
+// Package audit keeps an append-only JSON lines log of tunnel grants. Every entry carries the hash of
+// the entry before it, so editing, removing or reordering entries breaks the chain and is caught by Verify.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// EventGrant is a new tunnel
+	EventGrant = "grant"
+	// EventRotate is a new PSK for an existing tunnel
+	EventRotate = "rotate_psk"
+	// EventRenew is a new expiry for an existing tunnel
+	EventRenew = "renew"
+	// EventEnd is the removal of a tunnel, Reason says why
+	EventEnd = "end"
+	// EventDenied is a verified token the policy did not allow a tunnel for
+	EventDenied = "denied"
+)
+
+type Entry struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	RequestID string    `json:"request_id,omitempty"`
+	PublicKey string    `json:"public_key,omitempty"`
+	IPs       []string  `json:"ips,omitempty"`
+
+	// the identity the tunnel was issued to, with the GitHub Actions claims describing the job
+	Subject    string `json:"sub,omitempty"`
+	Issuer     string `json:"iss,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	Workflow   string `json:"workflow,omitempty"`
+	RunID      string `json:"run_id,omitempty"`
+	Actor      string `json:"actor,omitempty"`
+
+	// Expires is nil for tunnels that never expire
+	Expires *time.Time `json:"expires,omitempty"`
+	Reason  string     `json:"reason,omitempty"`
+
+	// PrevHash is the Hash of the previous entry, empty for the first one
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// hash covers the previous hash and the entry itself without its hash
+func (e Entry) hash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(e.PrevHash+"\n"), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Log appends entries to a file. A nil *Log discards everything, so auditing can be left unconfigured.
+type Log struct {
+	mu       sync.Mutex
+	file     *os.File
+	seq      uint64
+	lastHash string
+}
+
+// Open continues the chain of an existing log file or starts a new one. It refuses to extend a broken chain.
+// A partial last line is left by a crash while appending, the grant it was for never took effect and it is dropped.
+func Open(filename string) (*Log, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open audit log")
+	}
+
+	l, err := resume(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func resume(f *os.File) (*Log, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read audit log")
+	}
+	length, err := completeLength(f, info.Size())
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read audit log")
+	}
+	if length < info.Size() {
+		err = f.Truncate(length)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to drop the partial last line of the audit log")
+		}
+		err = f.Sync()
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to sync audit log")
+		}
+	}
+
+	seq, lastHash, err := Verify(io.NewSectionReader(f, 0, length))
+	if err != nil {
+		return nil, errors.Wrap(err, "audit log is broken, refusing to extend it")
+	}
+	return &Log{file: f, seq: seq, lastHash: lastHash}, nil
+}
+
+// completeLength is the length of a log up to and including its last newline
+func completeLength(f *os.File, size int64) (int64, error) {
+	buf := make([]byte, 4096)
+	end := size
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		n, err := f.ReadAt(buf[:end-start], start)
+		if err != nil {
+			return 0, err
+		}
+		i := bytes.LastIndexByte(buf[:n], '\n')
+		if i >= 0 {
+			return start + int64(i) + 1, nil
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// Append chains and writes an entry, it is synced to disk before Append returns
+func (l *Log) Append(e Entry) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = l.seq + 1
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	// strip the monotonic clock and zone so the entry hashes the same once read back
+	e.Time = e.Time.UTC().Round(0)
+	if e.Expires != nil {
+		expires := e.Expires.UTC().Round(0)
+		e.Expires = &expires
+	}
+	e.PrevHash = l.lastHash
+
+	hash, err := e.hash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(data, '\n'))
+	if err != nil {
+		return errors.Wrap(err, "unable to write audit log")
+	}
+	err = l.file.Sync()
+	if err != nil {
+		return errors.Wrap(err, "unable to sync audit log")
+	}
+
+	l.seq = e.Seq
+	l.lastHash = e.Hash
+	return nil
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// Verify checks the hash chain of a log and returns the number of entries and the hash of the last one.
+// A truncated log still verifies, keep the last hash elsewhere to detect that.
+func Verify(r io.Reader) (uint64, string, error) {
+	var seq uint64
+	var lastHash string
+
+	scanner := newScanner(r)
+	for scanner.Scan() {
+		var e Entry
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return seq, lastHash, errors.Wrapf(err, "entry %d is not valid JSON", seq+1)
+		}
+		if e.Seq != seq+1 {
+			return seq, lastHash, errors.Errorf("entry %d has sequence number %d", seq+1, e.Seq)
+		}
+		if e.PrevHash != lastHash {
+			return seq, lastHash, errors.Errorf("entry %d does not continue the chain", e.Seq)
+		}
+		hash, err := e.hash()
+		if err != nil {
+			return seq, lastHash, err
+		}
+		if hash != e.Hash {
+			return seq, lastHash, errors.Errorf("entry %d does not match its hash", e.Seq)
+		}
+		seq = e.Seq
+		lastHash = e.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return seq, lastHash, errors.Wrap(err, "unable to read audit log")
+	}
+	return seq, lastHash, nil
+}
+
+func newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	// claims can make for long lines
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	return scanner
+}
@@ -0,0 +1,84 @@
+package audit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.jsonl")
+	expires := time.Now().Add(time.Hour)
+
+	l, err := Open(filename)
+	require.NoError(t, err)
+	require.NoError(t, l.Append(Entry{Event: EventGrant, PublicKey: "key", Subject: "repo:acuteaura/app", Expires: &expires}))
+	require.NoError(t, l.Append(Entry{Event: EventEnd, PublicKey: "key", Reason: "deleted"}))
+	require.NoError(t, l.Close())
+
+	// the chain continues after reopening
+	l, err = Open(filename)
+	require.NoError(t, err)
+	require.NoError(t, l.Append(Entry{Event: EventGrant, PublicKey: "other"}))
+	require.NoError(t, l.Close())
+
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	n, lastHash, err := Verify(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, n)
+	assert.NotEmpty(t, lastHash)
+
+	lines := strings.SplitAfter(string(data), "\n")
+
+	tampered := strings.Join(lines, "")
+	tampered = strings.Replace(tampered, `"reason":"deleted"`, `"reason":"expired"`, 1)
+	_, _, err = Verify(strings.NewReader(tampered))
+	assert.ErrorContains(t, err, "entry 2 does not match its hash")
+
+	removed := lines[0] + lines[2]
+	_, _, err = Verify(strings.NewReader(removed))
+	assert.ErrorContains(t, err, "entry 2 has sequence number 3")
+}
+
+func TestOpen(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := Open(filename)
+	require.NoError(t, err)
+	require.NoError(t, l.Append(Entry{Event: EventGrant, PublicKey: "key"}))
+	require.NoError(t, l.Append(Entry{Event: EventEnd, PublicKey: "key", Reason: "deleted"}))
+	require.NoError(t, l.Close())
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+
+	// a line torn by a crash while appending is dropped
+	require.NoError(t, os.WriteFile(filename, append(data, `{"seq":3,"event":"gra`...), 0600))
+	l, err = Open(filename)
+	require.NoError(t, err)
+	require.NoError(t, l.Append(Entry{Event: EventGrant, PublicKey: "other"}))
+	require.NoError(t, l.Close())
+	resumed, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(resumed, data))
+	n, _, err := Verify(bytes.NewReader(resumed))
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, n)
+
+	// a broken chain is not extended
+	tampered := strings.Replace(string(data), `"reason":"deleted"`, `"reason":"expired"`, 1)
+	require.NoError(t, os.WriteFile(filename, []byte(tampered), 0600))
+	_, err = Open(filename)
+	assert.ErrorContains(t, err, "audit log is broken, refusing to extend it: entry 2 does not match its hash")
+}
+
+func TestLog_Nil(t *testing.T) {
+	var l *Log
+	assert.NoError(t, l.Append(Entry{Event: EventGrant}))
+	assert.NoError(t, l.Close())
+}
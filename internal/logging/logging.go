@@ -0,0 +1,54 @@
+// Package logging carries a request scoped slog.Logger through contexts
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+)
+
+type loggerKey struct{}
+
+type requestIDKey struct{}
+
+// New creates a JSON logger, which is what our log pipeline indexes. Pass a *slog.LevelVar to change the level later.
+func New(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// ParseLevel accepts debug, info, warn and error
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// WithLogger stores a logger in the context, usually one with request fields attached
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger of the context, or slog.Default() if there is none
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// With adds fields to the logger of the context
+func With(ctx context.Context, args ...any) context.Context {
+	return WithLogger(ctx, FromContext(ctx).With(args...))
+}
+
+// WithRequestID stores the request ID in the context and adds it to the logger
+func WithRequestID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	return With(ctx, "request_id", id)
+}
+
+// RequestID returns the request ID of the context, empty outside of requests
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,250 @@
+// Package metrics exposes metrics in the Prometheus text format. It only covers what tinybastion needs:
+// counters with at most one label, summaries without quantiles and anything computed at scrape time.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	TypeCounter = "counter"
+	TypeGauge   = "gauge"
+	TypeSummary = "summary"
+)
+
+// Family is a named metric with all its samples
+type Family struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+// Sample is a single value of a family. Suffix is appended to the family name, e.g. _sum for summaries.
+type Sample struct {
+	Suffix string
+	Labels map[string]string
+	Value  float64
+}
+
+// Collector produces families on every scrape
+type Collector interface {
+	Collect() []Family
+}
+
+// CollectorFunc adapts a function to a Collector
+type CollectorFunc func() []Family
+
+func (f CollectorFunc) Collect() []Family {
+	return f()
+}
+
+// Default is where the metrics of internal packages are registered
+var Default = NewRegistry()
+
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Gather collects all families, sorted by name
+func (r *Registry) Gather() []Family {
+	r.mu.Lock()
+	collectors := append([]Collector{}, r.collectors...)
+	r.mu.Unlock()
+
+	families := make([]Family, 0, len(collectors))
+	for _, c := range collectors {
+		families = append(families, c.Collect()...)
+	}
+	sort.SliceStable(families, func(i, j int) bool {
+		return families[i].Name < families[j].Name
+	})
+	return families
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, f := range r.Gather() {
+		writeFamily(bw, f)
+	}
+	bw.Flush()
+}
+
+func writeFamily(w *bufio.Writer, f Family) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.Name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.Help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.Name, f.Type)
+	for _, s := range f.Samples {
+		w.WriteString(f.Name + s.Suffix)
+		writeLabels(w, s.Labels)
+		w.WriteString(" " + strconv.FormatFloat(s.Value, 'g', -1, 64) + "\n")
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeLabels(w *bufio.Writer, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			w.WriteString(",")
+		}
+		w.WriteString(name + `="` + labelValueEscaper.Replace(labels[name]) + `"`)
+	}
+	w.WriteString("}")
+}
+
+// CounterVec is a counter split by a single label
+type CounterVec struct {
+	name  string
+	help  string
+	label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec creates a counter and registers it with Default. The given label values start out at zero,
+// so rates can be computed before they first occur.
+func NewCounterVec(name string, help string, label string, initial ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+	for _, v := range initial {
+		c.values[v] = 0
+	}
+	Default.Register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(value string) {
+	c.Add(value, 1)
+}
+
+func (c *CounterVec) Add(value string, v float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[value] += v
+}
+
+// Value returns the current count for a label value
+func (c *CounterVec) Value(value string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[value]
+}
+
+func (c *CounterVec) Collect() []Family {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := Family{Name: c.name, Help: c.help, Type: TypeCounter, Samples: make([]Sample, 0, len(c.values))}
+	for value, v := range c.values {
+		sample := Sample{Value: v}
+		if c.label != "" {
+			sample.Labels = map[string]string{c.label: value}
+		}
+		f.Samples = append(f.Samples, sample)
+	}
+	sortSamples(f.Samples, c.label)
+	return []Family{f}
+}
+
+// Counter is a counter without labels
+type Counter struct {
+	vec *CounterVec
+}
+
+// NewCounter creates a counter and registers it with Default
+func NewCounter(name string, help string) *Counter {
+	return &Counter{vec: NewCounterVec(name, help, "", "")}
+}
+
+func (c *Counter) Inc() {
+	c.vec.Inc("")
+}
+
+func (c *Counter) Add(v float64) {
+	c.vec.Add("", v)
+}
+
+func (c *Counter) Value() float64 {
+	return c.vec.Value("")
+}
+
+// SummaryVec tracks count and sum of observations, split by a single label
+type SummaryVec struct {
+	name  string
+	help  string
+	label string
+
+	mu     sync.Mutex
+	counts map[string]uint64
+	sums   map[string]float64
+}
+
+// NewSummaryVec creates a summary and registers it with Default
+func NewSummaryVec(name string, help string, label string) *SummaryVec {
+	s := &SummaryVec{name: name, help: help, label: label, counts: make(map[string]uint64), sums: make(map[string]float64)}
+	Default.Register(s)
+	return s
+}
+
+func (s *SummaryVec) Observe(value string, v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[value]++
+	s.sums[value] += v
+}
+
+func (s *SummaryVec) Collect() []Family {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := Family{Name: s.name, Help: s.help, Type: TypeSummary, Samples: make([]Sample, 0, 2*len(s.counts))}
+	for value, count := range s.counts {
+		labels := map[string]string{s.label: value}
+		f.Samples = append(f.Samples,
+			Sample{Suffix: "_sum", Labels: labels, Value: s.sums[value]},
+			Sample{Suffix: "_count", Labels: labels, Value: float64(count)},
+		)
+	}
+	sortSamples(f.Samples, s.label)
+	return []Family{f}
+}
+
+// sortSamples keeps the output stable, which is nicer to read and diff
+func sortSamples(samples []Sample, label string) {
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Labels[label] < samples[j].Labels[label]
+	})
+}
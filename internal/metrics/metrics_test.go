@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	r := NewRegistry()
+
+	requests := &CounterVec{name: "test_requests_total", help: "Requests.", label: "outcome", values: map[string]float64{"error": 0}}
+	requests.Inc("success")
+	requests.Add("success", 2)
+	r.Register(requests)
+
+	durations := &SummaryVec{name: "test_duration_seconds", help: "Durations.", label: "kind", counts: map[string]uint64{}, sums: map[string]float64{}}
+	durations.Observe("jwks", 0.5)
+	durations.Observe("jwks", 0.25)
+	r.Register(durations)
+
+	r.Register(CollectorFunc(func() []Family {
+		return []Family{{Name: "test_peers", Help: "Peers,\nwith a newline.", Type: TypeGauge, Samples: []Sample{
+			{Labels: map[string]string{"prefix": "10.0.0.0/24", "state": "used"}, Value: 3},
+			{Labels: map[string]string{"key": `a"b\c`}, Value: 1},
+		}}}
+	}))
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds summary
+test_duration_seconds_sum{kind="jwks"} 0.75
+test_duration_seconds_count{kind="jwks"} 2
+# HELP test_peers Peers,\nwith a newline.
+# TYPE test_peers gauge
+test_peers{prefix="10.0.0.0/24",state="used"} 3
+test_peers{key="a\"b\\c"} 1
+# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{outcome="error"} 0
+test_requests_total{outcome="success"} 3
+`, string(body))
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_counter_total", "A counter.")
+	c.Inc()
+	c.Add(2)
+	assert.Equal(t, float64(3), c.Value())
+
+	families := c.vec.Collect()
+	require.Len(t, families, 1)
+	assert.Equal(t, []Sample{{Value: 3}}, families[0].Samples)
+}
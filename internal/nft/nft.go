@@ -0,0 +1,243 @@
+package nft
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Ruleset describes everything the bastion wants from netfilter. It is always rendered and applied as a whole,
+// so the table never contains anything we do not know about.
+type Ruleset struct {
+	// Interface is the wireguard device
+	Interface string
+	// TunnelPrefixes are the networks peer addresses are allocated from
+	TunnelPrefixes []*net.IPNet
+	// RoutedNetworks are reachable for peers through the bastion, traffic towards them is masqueraded
+	RoutedNetworks []*net.IPNet
+	// Peers get forwarding rules keyed on their tunnel addresses, forwarded traffic from anything else is dropped
+	Peers []Peer
+	// PeerIsolation drops traffic between peers, unless they share a group
+	PeerIsolation bool
+}
+
+// Peer is the set of forwarding rules for a single peer.
+type Peer struct {
+	Addresses []net.IP
+	// Grants restrict where the peer may go within RoutedNetworks, nil allows all of them
+	Grants []Grant
+	// Group members can reach each other with PeerIsolation enabled
+	Group string
+}
+
+// Grant allows traffic towards a network, optionally limited to a protocol and ports.
+type Grant struct {
+	Network  *net.IPNet
+	Protocol string
+	Ports    []uint16
+}
+
+// Table manages a single nftables table through the nft binary.
+type Table struct {
+	Name string
+}
+
+func NewTable(name string) *Table {
+	return &Table{Name: name}
+}
+
+// Apply atomically replaces the table with the rendered ruleset.
+func (t *Table) Apply(r *Ruleset) error {
+	return run(r.Render(t.Name))
+}
+
+// Destroy removes the table, if it exists.
+func (t *Table) Destroy() error {
+	// declaring the table first makes deleting it idempotent
+	return run(fmt.Sprintf("table inet %s\ndelete table inet %s\n", t.Name, t.Name))
+}
+
+func run(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return errors.Wrapf(err, "nft failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Render returns an nft script that replaces the table in a single transaction.
+func (r *Ruleset) Render(table string) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "table inet %s\n", table)
+	fmt.Fprintf(b, "delete table inet %s\n", table)
+	fmt.Fprintf(b, "table inet %s {\n", table)
+
+	b.WriteString("\tchain forward {\n")
+	b.WriteString("\t\ttype filter hook forward priority 0; policy accept;\n")
+	// traffic between peers enters and leaves through the tunnel, everything else from peers is up to their grants
+	if r.PeerIsolation {
+		fmt.Fprintf(b, "\t\tiifname %q oifname %q jump isolation\n", r.Interface, r.Interface)
+	} else {
+		fmt.Fprintf(b, "\t\tiifname %q oifname %q accept\n", r.Interface, r.Interface)
+	}
+	fmt.Fprintf(b, "\t\tiifname %q jump peers\n", r.Interface)
+	b.WriteString("\t}\n")
+
+	if r.PeerIsolation {
+		b.WriteString("\tchain isolation {\n")
+		r.renderGroups(b)
+		b.WriteString("\t\tdrop\n")
+		b.WriteString("\t}\n")
+	}
+
+	b.WriteString("\tchain peers {\n")
+	for _, peer := range r.Peers {
+		for _, addr := range peer.Addresses {
+			r.renderPeer(b, addr, peer.Grants)
+		}
+	}
+	b.WriteString("\t\tdrop\n")
+	b.WriteString("\t}\n")
+
+	b.WriteString("\tchain postrouting {\n")
+	b.WriteString("\t\ttype nat hook postrouting priority 100; policy accept;\n")
+	for _, prefix := range r.TunnelPrefixes {
+		family := familyOf(prefix)
+		routed := filterFamily(r.RoutedNetworks, family)
+		if len(routed) == 0 {
+			continue
+		}
+		fmt.Fprintf(b, "\t\tiifname %q %s saddr %s %s daddr %s masquerade\n", r.Interface, family, prefix, family, set(routed))
+	}
+	b.WriteString("\t}\n")
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func (r *Ruleset) renderGroups(b *strings.Builder) {
+	groups := make(map[string][]net.IP)
+	for _, peer := range r.Peers {
+		if peer.Group == "" {
+			continue
+		}
+		groups[peer.Group] = append(groups[peer.Group], peer.Addresses...)
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, family := range []string{"ip", "ip6"} {
+			members := make([]net.IP, 0, len(groups[name]))
+			for _, addr := range groups[name] {
+				if (addr.To4() != nil) == (family == "ip") {
+					members = append(members, addr)
+				}
+			}
+			// a lone peer has nobody to talk to
+			if len(members) < 2 {
+				continue
+			}
+			fmt.Fprintf(b, "\t\t%s saddr %s %s daddr %s accept comment %q\n", family, set(members), family, set(members), name)
+		}
+	}
+}
+
+func (r *Ruleset) renderPeer(b *strings.Builder, addr net.IP, grants []Grant) {
+	family := "ip"
+	if addr.To4() == nil {
+		family = "ip6"
+	}
+
+	if grants == nil {
+		routed := filterFamily(r.RoutedNetworks, family)
+		if len(routed) > 0 {
+			fmt.Fprintf(b, "\t\t%s saddr %s %s daddr %s accept\n", family, addr, family, set(routed))
+		}
+		return
+	}
+
+	for _, grant := range grants {
+		if familyOf(grant.Network) != family {
+			continue
+		}
+		// grants never reach beyond the routed networks, only those are masqueraded and meant for peers
+		for _, routed := range filterFamily(r.RoutedNetworks, family) {
+			network := intersect(grant.Network, routed)
+			if network != nil {
+				renderGrant(b, family, addr, network, grant)
+			}
+		}
+	}
+}
+
+func renderGrant(b *strings.Builder, family string, addr net.IP, network *net.IPNet, grant Grant) {
+	fmt.Fprintf(b, "\t\t%s saddr %s %s daddr %s", family, addr, family, network)
+	switch {
+	case len(grant.Ports) > 0:
+		ports := make([]string, 0, len(grant.Ports))
+		for _, port := range grant.Ports {
+			ports = append(ports, strconv.Itoa(int(port)))
+		}
+		fmt.Fprintf(b, " %s dport { %s }", grant.Protocol, strings.Join(ports, ", "))
+	case grant.Protocol != "":
+		fmt.Fprintf(b, " meta l4proto %s", grant.Protocol)
+	}
+	b.WriteString(" accept\n")
+}
+
+// intersect returns the smaller of two networks if one contains the other, nil if they don't overlap
+func intersect(a, b *net.IPNet) *net.IPNet {
+	aOnes, aBits := a.Mask.Size()
+	bOnes, bBits := b.Mask.Size()
+	switch {
+	case aBits != bBits:
+		return nil
+	case aOnes >= bOnes && b.Contains(a.IP):
+		return a
+	case bOnes >= aOnes && a.Contains(b.IP):
+		return b
+	}
+	return nil
+}
+
+// family returns the nft address family keyword for a network
+func familyOf(n *net.IPNet) string {
+	if n.IP.To4() != nil {
+		return "ip"
+	}
+	return "ip6"
+}
+
+func filterFamily(networks []*net.IPNet, f string) []*net.IPNet {
+	filtered := make([]*net.IPNet, 0, len(networks))
+	for _, n := range networks {
+		if familyOf(n) == f {
+			filtered = append(filtered, n)
+		}
+	}
+	return filtered
+}
+
+// set renders an anonymous nft set
+func set[T fmt.Stringer](elements []T) string {
+	s := make([]string, 0, len(elements))
+	for _, e := range elements {
+		s = append(s, e.String())
+	}
+	return "{ " + strings.Join(s, ", ") + " }"
+}
@@ -0,0 +1,136 @@
+package nft
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestRuleset_Render(t *testing.T) {
+	r := &Ruleset{
+		Interface:      "tinybastion",
+		TunnelPrefixes: []*net.IPNet{mustParseCIDR("10.0.0.0/24"), mustParseCIDR("fd00::/64")},
+		RoutedNetworks: []*net.IPNet{mustParseCIDR("192.168.0.0/16"), mustParseCIDR("172.16.0.0/12"), mustParseCIDR("fd12::/48")},
+		Peers: []Peer{
+			{
+				Addresses: []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")},
+			},
+			{
+				Addresses: []net.IP{net.ParseIP("10.0.0.3"), net.ParseIP("fd00::3")},
+				Grants: []Grant{
+					{Network: mustParseCIDR("192.168.1.0/24"), Protocol: "tcp", Ports: []uint16{5432, 6379}},
+					{Network: mustParseCIDR("172.16.1.1/32"), Protocol: "udp"},
+					{Network: mustParseCIDR("fd12::/64")},
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, `table inet tb
+delete table inet tb
+table inet tb {
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+		iifname "tinybastion" oifname "tinybastion" accept
+		iifname "tinybastion" jump peers
+	}
+	chain peers {
+		ip saddr 10.0.0.2 ip daddr { 192.168.0.0/16, 172.16.0.0/12 } accept
+		ip6 saddr fd00::2 ip6 daddr { fd12::/48 } accept
+		ip saddr 10.0.0.3 ip daddr 192.168.1.0/24 tcp dport { 5432, 6379 } accept
+		ip saddr 10.0.0.3 ip daddr 172.16.1.1/32 meta l4proto udp accept
+		ip6 saddr fd00::3 ip6 daddr fd12::/64 accept
+		drop
+	}
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		iifname "tinybastion" ip saddr 10.0.0.0/24 ip daddr { 192.168.0.0/16, 172.16.0.0/12 } masquerade
+		iifname "tinybastion" ip6 saddr fd00::/64 ip6 daddr { fd12::/48 } masquerade
+	}
+}
+`, r.Render("tb"))
+}
+
+func TestRuleset_RenderGrantsOutsideRoutedNetworks(t *testing.T) {
+	r := &Ruleset{
+		Interface:      "tinybastion",
+		TunnelPrefixes: []*net.IPNet{mustParseCIDR("10.0.0.0/24")},
+		RoutedNetworks: []*net.IPNet{mustParseCIDR("192.168.0.0/16"), mustParseCIDR("172.16.0.0/12")},
+		Peers: []Peer{
+			{
+				Addresses: []net.IP{net.ParseIP("10.0.0.2")},
+				Grants: []Grant{
+					{Network: mustParseCIDR("0.0.0.0/0"), Protocol: "tcp", Ports: []uint16{22}},
+					{Network: mustParseCIDR("169.254.169.254/32")},
+					{Network: mustParseCIDR("192.168.1.0/24")},
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, `table inet tb
+delete table inet tb
+table inet tb {
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+		iifname "tinybastion" oifname "tinybastion" accept
+		iifname "tinybastion" jump peers
+	}
+	chain peers {
+		ip saddr 10.0.0.2 ip daddr 192.168.0.0/16 tcp dport { 22 } accept
+		ip saddr 10.0.0.2 ip daddr 172.16.0.0/12 tcp dport { 22 } accept
+		ip saddr 10.0.0.2 ip daddr 192.168.1.0/24 accept
+		drop
+	}
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		iifname "tinybastion" ip saddr 10.0.0.0/24 ip daddr { 192.168.0.0/16, 172.16.0.0/12 } masquerade
+	}
+}
+`, r.Render("tb"))
+}
+
+func TestRuleset_RenderIsolation(t *testing.T) {
+	r := &Ruleset{
+		Interface:      "tinybastion",
+		TunnelPrefixes: []*net.IPNet{mustParseCIDR("10.0.0.0/24")},
+		PeerIsolation:  true,
+		Peers: []Peer{
+			{Addresses: []net.IP{net.ParseIP("10.0.0.2")}, Group: "b"},
+			{Addresses: []net.IP{net.ParseIP("10.0.0.3")}, Group: "a"},
+			{Addresses: []net.IP{net.ParseIP("10.0.0.4")}, Group: "b"},
+			{Addresses: []net.IP{net.ParseIP("10.0.0.5")}, Group: "c"},
+			{Addresses: []net.IP{net.ParseIP("10.0.0.6")}},
+		},
+	}
+
+	assert.Equal(t, `table inet tb
+delete table inet tb
+table inet tb {
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+		iifname "tinybastion" oifname "tinybastion" jump isolation
+		iifname "tinybastion" jump peers
+	}
+	chain isolation {
+		ip saddr { 10.0.0.2, 10.0.0.4 } ip daddr { 10.0.0.2, 10.0.0.4 } accept comment "b"
+		drop
+	}
+	chain peers {
+		drop
+	}
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+	}
+}
+`, r.Render("tb"))
+}
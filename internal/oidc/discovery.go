@@ -3,83 +3,219 @@ package oidc
 import (
 	"context"
 	"encoding/json"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"net/url"
 	"path"
+	"sync"
+	"time"
 
-	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/acuteaura/tinybastion/internal/logging"
+	"github.com/acuteaura/tinybastion/internal/metrics"
 
-	"log"
+	"github.com/lestrrat-go/jwx/jwk"
 
 	"github.com/pkg/errors"
 )
 
+// MinRefreshInterval is how long to wait between fetches of the JWKS of an issuer on behalf of requests,
+// so tokens with made up key IDs or an unreachable issuer don't cause a fetch per request
+const MinRefreshInterval = time.Minute
+
 func NewDiscoveryClient() *DiscoveryClient {
 	return &DiscoveryClient{
-		Cache:      NewOIDCCache(),
-		httpClient: http.DefaultClient,
+		Cache:       NewOIDCCache(),
+		httpClient:  http.DefaultClient,
+		lastRefresh: map[string]time.Time{},
 	}
 }
 
 type DiscoveryClient struct {
 	Cache      *OIDCCache
 	httpClient *http.Client
+
+	// lastRefresh is when the JWKS of an issuer was last refetched or failed to be fetched on behalf of a request,
+	// to rate limit those. Background refreshes and successful first fetches are not recorded, they don't stand
+	// in the way of fetching a key the issuer rotated to.
+	lastRefresh   map[string]time.Time
+	lastRefreshMu sync.Mutex
 }
 
-func (dc *DiscoveryClient) GetDiscoveryRoot(issuer string) (*DiscoveryResponse, error) {
+var (
+	fetchDuration = metrics.NewSummaryVec("tinybastion_oidc_fetch_duration_seconds", "Time spent fetching OIDC discovery documents and key sets.", "kind")
+	fetchFailures = metrics.NewCounterVec("tinybastion_oidc_fetch_failures_total", "Failed fetches of OIDC discovery documents and key sets.", "kind", "discovery", "jwks")
+	staleKeys     = metrics.NewCounter("tinybastion_oidc_stale_jwks_total", "Tokens verified against an expired JWKS because it could not be refreshed.")
+)
+
+// observeFetch records the duration and outcome of a fetch that started at start
+func observeFetch(kind string, start time.Time, err error) {
+	fetchDuration.Observe(kind, time.Since(start).Seconds())
+	if err != nil {
+		fetchFailures.Inc(kind)
+	}
+}
+
+func (dc *DiscoveryClient) GetDiscoveryRoot(ctx context.Context, issuer string) (*DiscoveryResponse, error) {
 	if dr := dc.Cache.GetResponse(issuer); dr != nil {
 		return dr, nil
 	}
-	issuerUrl, err := url.Parse(issuer)
+
+	return dc.refreshDiscoveryRoot(ctx, issuer)
+}
+
+// refreshDiscoveryRoot fetches and caches the discovery document of an issuer regardless of the cache
+func (dc *DiscoveryClient) refreshDiscoveryRoot(ctx context.Context, issuer string) (*DiscoveryResponse, error) {
+	start := time.Now()
+	dr, ttl, err := dc.fetchDiscoveryRoot(ctx, issuer)
+	observeFetch("discovery", start, err)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not parse issuer as URL")
+		logging.FromContext(ctx).Error("unable to fetch OIDC discovery configuration", "issuer", issuer, "error", err)
+		return nil, err
 	}
-	issuerUrl.Path = path.Join(issuerUrl.Path, ".well-known", "openid-configuration")
-	res, err := dc.httpClient.Get(issuerUrl.String())
+	logging.FromContext(ctx).Info("fetched OIDC discovery configuration", "issuer", issuer, "duration", time.Since(start), "ttl", ttl)
+	dc.Cache.StoreResponse(issuer, *dr, ttl)
+	return dr, nil
+}
+
+// fetchDiscoveryRoot returns the discovery document of an issuer and how long it may be cached
+func (dc *DiscoveryClient) fetchDiscoveryRoot(ctx context.Context, issuer string) (*DiscoveryResponse, time.Duration, error) {
+	issuerUrl, err := url.Parse(issuer)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to retrieve OIDC discovery configuration")
+		return nil, 0, errors.Wrap(err, "could not parse issuer as URL")
 	}
-	if res.StatusCode >= 400 {
-		return nil, errors.Wrap(errors.Errorf("unexpected status code %d", res.StatusCode), "unable to retrieve OIDC discovery configuration")
-	}
-	discoveryResponseBytes, err := ioutil.ReadAll(res.Body)
+	issuerUrl.Path = path.Join(issuerUrl.Path, ".well-known", "openid-configuration")
+	discoveryResponseBytes, ttl, err := dc.get(ctx, issuerUrl.String())
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to read OIDC discovery configuration from request body")
+		return nil, 0, errors.Wrap(err, "unable to retrieve OIDC discovery configuration")
 	}
 	dr := &DiscoveryResponse{}
 	err = json.Unmarshal(discoveryResponseBytes, dr)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to unmarshal configuration from request body")
+		return nil, 0, errors.Wrap(err, "unable to unmarshal configuration from request body")
 	}
 	if dr.Issuer == "" {
-		return nil, errors.New("bad response from OIDC discovery endpoint (missing issuer)")
+		return nil, 0, errors.New("bad response from OIDC discovery endpoint (missing issuer)")
 	}
 	if issuer != dr.Issuer {
-		log.Default().Printf("discovery returned non-matching issuer, expected '%s', got '%s'", issuer, dr.Issuer)
+		logging.FromContext(ctx).Warn("discovery returned non-matching issuer", "issuer", issuer, "discovered_issuer", dr.Issuer)
 	}
-	dc.Cache.StoreResponse(*dr)
-	return dr, nil
+	return dr, ttl, nil
+}
+
+// get fetches a document and returns it along with how long it may be cached
+func (dc *DiscoveryClient) get(ctx context.Context, u string) ([]byte, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	res, err := dc.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 {
+		return nil, 0, errors.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "unable to read response body")
+	}
+	return data, cacheTTL(res.Header), nil
 }
 
-func (dc *DiscoveryClient) GetJWKs(issuer string) (jwk.Set, error) {
-	cachedKeys := dc.Cache.GetKeys(issuer)
+// GetJWKs returns the key set of an issuer that should contain keyID, empty if unknown.
+// The set is fetched if it isn't cached, expired or lacks keyID, at most every MinRefreshInterval.
+// If that fails, the cached set is returned even if it expired, so an unreachable issuer doesn't stop verification.
+func (dc *DiscoveryClient) GetJWKs(ctx context.Context, issuer string, keyID string) (jwk.Set, error) {
+	cachedKeys, fresh := dc.Cache.LookupKeys(issuer)
 	if cachedKeys != nil {
+		_, known := cachedKeys.LookupKeyID(keyID)
+		if fresh && (keyID == "" || known) {
+			return cachedKeys, nil
+		}
+	}
+	if !dc.refreshAllowed(issuer) {
+		if cachedKeys == nil {
+			return nil, errors.Errorf("no keys of issuer %s cached and fetching them failed less than %s ago", issuer, MinRefreshInterval)
+		}
+		// verification fails if the key is missing, which is all a made up key ID deserves
+		return cachedKeys, nil
+	}
+	if cachedKeys != nil && fresh {
+		logging.FromContext(ctx).Info("refreshing JWKS for unknown key ID", "issuer", issuer, "kid", keyID)
+	}
+
+	keys, err := dc.fetchJWKs(ctx, issuer)
+	if err == nil && cachedKeys == nil {
+		// filling the cache isn't a refresh, only failing to is
+		dc.forgetRefresh(issuer)
+	}
+	if err != nil && cachedKeys != nil {
+		staleKeys.Inc()
+		logging.FromContext(ctx).Warn("unable to refresh JWKS, using cached keys", "issuer", issuer, "error", err)
 		return cachedKeys, nil
 	}
-	dr, err := dc.GetDiscoveryRoot(issuer)
+	return keys, err
+}
+
+// refreshAllowed tells whether the JWKS of an issuer may be fetched again, and if so, records that it is
+func (dc *DiscoveryClient) refreshAllowed(issuer string) bool {
+	dc.lastRefreshMu.Lock()
+	defer dc.lastRefreshMu.Unlock()
+
+	now := timeNow()
+	if last, ok := dc.lastRefresh[issuer]; ok && now.Sub(last) < MinRefreshInterval {
+		return false
+	}
+	dc.lastRefresh[issuer] = now
+	return true
+}
+
+// forgetRefresh lifts the rate limit of an issuer
+func (dc *DiscoveryClient) forgetRefresh(issuer string) {
+	dc.lastRefreshMu.Lock()
+	defer dc.lastRefreshMu.Unlock()
+	delete(dc.lastRefresh, issuer)
+}
+
+func (dc *DiscoveryClient) fetchJWKs(ctx context.Context, issuer string) (jwk.Set, error) {
+	dr, err := dc.GetDiscoveryRoot(ctx, issuer)
 	if err != nil {
 		return nil, err
 	}
 
-	keys, err := jwk.Fetch(context.TODO(), dr.JwksUri)
+	start := time.Now()
+	data, ttl, err := dc.get(ctx, dr.JwksUri)
+	var keys jwk.Set
+	if err == nil {
+		keys, err = jwk.Parse(data)
+	}
+	observeFetch("jwks", start, err)
 	if err != nil {
+		logging.FromContext(ctx).Error("unable to fetch JWKS", "issuer", issuer, "jwks_uri", dr.JwksUri, "error", err)
 		return nil, err
 	}
-	dc.Cache.StoreKeys(issuer, keys)
+	logging.FromContext(ctx).Info("fetched JWKS", "issuer", issuer, "keys", keys.Len(), "duration", time.Since(start), "ttl", ttl)
+	dc.Cache.StoreKeys(issuer, keys, ttl)
 	return keys, nil
 }
 
+// Refresh fetches the discovery documents and keys of the issuers that are not cached or about to expire,
+// so requests don't have to wait for them. Failures are logged, requests fall back to fetching themselves.
+func (dc *DiscoveryClient) Refresh(ctx context.Context, issuers []string) {
+	for _, issuer := range issuers {
+		if dc.Cache.ResponseDue(issuer) {
+			// the cached document is used until it expires if this fails
+			_, _ = dc.refreshDiscoveryRoot(ctx, issuer)
+		}
+		// this runs every RefreshInterval at most, so it doesn't need the rate limit of requests,
+		// and must not use it up either
+		if dc.Cache.KeysDue(issuer) {
+			_, _ = dc.fetchJWKs(ctx, issuer)
+		}
+	}
+}
+
 type DiscoveryResponse struct {
 	Issuer                string `json:"issuer"`
 	AuthorizationEndpoint string `json:"authorization_endpoint"`
@@ -1,6 +1,9 @@
 package oidc
 
 import (
+	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,6 +13,14 @@ import (
 // make it possible to test cache exp without a 30 min test
 var timeNow = time.Now
 
+const (
+	// DefaultCacheTTL is used for responses without caching headers
+	DefaultCacheTTL = 30 * time.Minute
+	// MinCacheTTL and MaxCacheTTL bound what caching headers can ask for
+	MinCacheTTL = 5 * time.Minute
+	MaxCacheTTL = 24 * time.Hour
+)
+
 func NewOIDCCache() *OIDCCache {
 	return &OIDCCache{
 		responseCache: map[string]discoveryResponseCacheEntry{},
@@ -26,21 +37,29 @@ type OIDCCache struct {
 
 type discoveryResponseCacheEntry struct {
 	exp time.Time
-	res *DiscoveryResponse
+	// refresh is when the entry should be fetched again in the background, before it expires
+	refresh time.Time
+	res     *DiscoveryResponse
 }
 
 type jwkCacheEntry struct {
-	exp time.Time
-	set jwk.Set
+	exp     time.Time
+	refresh time.Time
+	set     jwk.Set
 }
 
-func (dc *OIDCCache) StoreResponse(response DiscoveryResponse) {
-	dce := discoveryResponseCacheEntry{
-		exp: timeNow().Add(time.Minute * 30),
-		res: &response,
-	}
+// refreshTimes returns when an entry stored now for ttl is due for a refresh and when it expires.
+// It is refreshed once three quarters of the ttl passed.
+func refreshTimes(ttl time.Duration) (time.Time, time.Time) {
+	now := timeNow()
+	return now.Add(ttl * 3 / 4), now.Add(ttl)
+}
+
+func (dc *OIDCCache) StoreResponse(issuer string, response DiscoveryResponse, ttl time.Duration) {
+	dce := discoveryResponseCacheEntry{res: &response}
+	dce.refresh, dce.exp = refreshTimes(ttl)
 	dc.responseCacheMu.Lock()
-	dc.responseCache[response.Issuer] = dce
+	dc.responseCache[issuer] = dce
 	dc.responseCacheMu.Unlock()
 }
 
@@ -57,25 +76,96 @@ func (dc *OIDCCache) GetResponse(issuer string) *DiscoveryResponse {
 	return dce.res
 }
 
-func (dc *OIDCCache) StoreKeys(issuer string, set jwk.Set) {
-	dce := jwkCacheEntry{
-		exp: timeNow().Add(time.Minute * 30),
-		set: set,
-	}
+// ResponseDue tells whether the discovery document of an issuer is missing or should be refreshed
+func (dc *OIDCCache) ResponseDue(issuer string) bool {
+	dc.responseCacheMu.RLock()
+	dce, ok := dc.responseCache[issuer]
+	dc.responseCacheMu.RUnlock()
+	return !ok || !timeNow().Before(dce.refresh)
+}
+
+func (dc *OIDCCache) StoreKeys(issuer string, set jwk.Set, ttl time.Duration) {
+	dce := jwkCacheEntry{set: set}
+	dce.refresh, dce.exp = refreshTimes(ttl)
 	dc.jwkCacheMu.Lock()
 	dc.jwkCache[issuer] = dce
 	dc.jwkCacheMu.Unlock()
 }
 
 func (dc *OIDCCache) GetKeys(issuer string) jwk.Set {
+	set, fresh := dc.LookupKeys(issuer)
+	if !fresh {
+		return nil
+	}
+	return set
+}
+
+// LookupKeys returns the cached keys of an issuer even if they expired, fresh tells whether they did not
+func (dc *OIDCCache) LookupKeys(issuer string) (set jwk.Set, fresh bool) {
 	dc.jwkCacheMu.RLock()
 	dce, ok := dc.jwkCache[issuer]
 	dc.jwkCacheMu.RUnlock()
 	if !ok {
-		return nil
+		return nil, false
 	}
-	if timeNow().After(dce.exp) {
-		return nil
+	return dce.set, !timeNow().After(dce.exp)
+}
+
+// KeysDue tells whether the keys of an issuer are missing or should be refreshed
+func (dc *OIDCCache) KeysDue(issuer string) bool {
+	dc.jwkCacheMu.RLock()
+	dce, ok := dc.jwkCache[issuer]
+	dc.jwkCacheMu.RUnlock()
+	return !ok || !timeNow().Before(dce.refresh)
+}
+
+// cacheTTL reads how long a response may be cached from its Cache-Control max-age or Expires header,
+// bounded by MinCacheTTL and MaxCacheTTL. Responses that must not be cached are cached for MinCacheTTL,
+// we can't verify tokens without them.
+func cacheTTL(header http.Header) time.Duration {
+	ttl, ok := headerTTL(header)
+	if !ok {
+		return DefaultCacheTTL
+	}
+	if ttl < MinCacheTTL {
+		return MinCacheTTL
+	}
+	if ttl > MaxCacheTTL {
+		return MaxCacheTTL
+	}
+	return ttl
+}
+
+func headerTTL(header http.Header) (time.Duration, bool) {
+	maxAge := -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0, true
+		case "max-age":
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err == nil {
+				maxAge = seconds
+			}
+		}
+	}
+	if maxAge >= 0 {
+		return time.Duration(maxAge) * time.Second, true
+	}
+
+	if header.Get("Expires") == "" {
+		return 0, false
+	}
+	expires, err := http.ParseTime(header.Get("Expires"))
+	if err != nil {
+		// an invalid Expires means already expired
+		return 0, true
+	}
+	// relative to the clock of the server if it told us, so clock skew doesn't matter
+	now := timeNow()
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		now = date
 	}
-	return dce.set
+	return expires.Sub(now), true
 }
@@ -1,13 +1,20 @@
 package oidc
 
-import "github.com/lestrrat-go/jwx/jwt"
+import (
+	"context"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/pkg/errors"
+)
 
 var DefaultProvider = NewProvider()
 
 var _ ProviderInterface = DefaultProvider
 
 type ProviderInterface interface {
-	VerifyToken(tokenString string, issuer string, options ...jwt.ParseOption) (jwt.Token, error)
+	VerifyToken(ctx context.Context, tokenString string, issuer string, audience string, options ...jwt.ParseOption) (jwt.Token, error)
 }
 
 func NewProvider() *Provider {
@@ -25,20 +32,69 @@ type Provider struct {
 	discovery *DiscoveryClient
 }
 
-func (p *Provider) VerifyToken(tokenString string, issuer string, options ...jwt.ParseOption) (jwt.Token, error) {
-	keychain, err := p.discovery.GetJWKs(issuer)
+// VerifyToken checks the signature of a token against the keys of the issuer, and its issuer, expiry and
+// not-before claims. With a non-empty audience, the token must be issued for it too.
+func (p *Provider) VerifyToken(ctx context.Context, tokenString string, issuer string, audience string, options ...jwt.ParseOption) (jwt.Token, error) {
+	keychain, err := p.discovery.GetJWKs(ctx, issuer, unverifiedKeyID(tokenString))
 	if err != nil {
 		return nil, err
 	}
 
+	// claims are only checked with WithValidate
 	options = append(options,
+		jwt.WithValidate(true),
 		jwt.WithIssuer(issuer),
 		jwt.WithKeySet(keychain),
-		jwt.WithClaimValue("typ", "ID"),
 	)
+	if audience != "" {
+		options = append(options, jwt.WithAudience(audience))
+	}
 
 	return jwt.ParseString(
 		tokenString,
 		options...,
 	)
 }
+
+// RefreshInterval is how often KeepWarm checks for cache entries about to expire
+const RefreshInterval = time.Minute
+
+// KeepWarm fetches what the issuers need for verification right away, and then refreshes it in the background
+// before it expires, until ctx is done. issuers is called every time, so it can change.
+func (p *Provider) KeepWarm(ctx context.Context, interval time.Duration, issuers func() []string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// an issuer that doesn't answer must not hold up the next round
+		refreshCtx, cancel := context.WithTimeout(ctx, interval)
+		p.discovery.Refresh(refreshCtx, issuers())
+		cancel()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// UnverifiedIssuer reads the iss claim of a token without verifying it, only to pick the issuer to verify it against
+func UnverifiedIssuer(tokenString string) (string, error) {
+	// without a key set the signature is not checked
+	token, err := jwt.ParseString(tokenString)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to parse token")
+	}
+	if token.Issuer() == "" {
+		return "", errors.New("token has no issuer")
+	}
+	return token.Issuer(), nil
+}
+
+// unverifiedKeyID reads the kid header of a token, empty if it has none or can't be parsed
+func unverifiedKeyID(tokenString string) string {
+	msg, err := jws.ParseString(tokenString)
+	if err != nil || len(msg.Signatures()) == 0 {
+		return ""
+	}
+	return msg.Signatures()[0].ProtectedHeaders().KeyID()
+}
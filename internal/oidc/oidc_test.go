@@ -0,0 +1,267 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testIssuer serves a discovery document and a key set with a single RSA key, which can be rotated
+type testIssuer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	key         jwk.Key
+	set         jwk.Set
+	failing     bool
+	jwksFetches int
+	// cacheControl is sent along with the keys
+	cacheControl string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	ti := &testIssuer{}
+	ti.rotate(t, "test")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(DiscoveryResponse{Issuer: ti.URL, JwksUri: ti.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		ti.mu.Lock()
+		defer ti.mu.Unlock()
+		ti.jwksFetches++
+		if ti.failing {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if ti.cacheControl != "" {
+			w.Header().Set("Cache-Control", ti.cacheControl)
+		}
+		json.NewEncoder(w).Encode(ti.set)
+	})
+	ti.Server = httptest.NewServer(mux)
+	t.Cleanup(ti.Close)
+	return ti
+}
+
+// rotate replaces the signing key with a new one
+func (ti *testIssuer) rotate(t *testing.T, keyID string) {
+	raw, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key, err := jwk.New(raw)
+	require.NoError(t, err)
+	require.NoError(t, key.Set(jwk.KeyIDKey, keyID))
+	require.NoError(t, key.Set(jwk.AlgorithmKey, jwa.RS256))
+	public, err := key.PublicKey()
+	require.NoError(t, err)
+	set := jwk.NewSet()
+	set.Add(public)
+
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.key = key
+	ti.set = set
+}
+
+func (ti *testIssuer) setFailing(failing bool) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.failing = failing
+}
+
+func (ti *testIssuer) fetches() int {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.jwksFetches
+}
+
+func (ti *testIssuer) token(t *testing.T, claims map[string]interface{}) string {
+	token := jwt.New()
+	require.NoError(t, token.Set(jwt.IssuerKey, ti.URL))
+	require.NoError(t, token.Set(jwt.SubjectKey, "repo:acuteaura/tinybastion:ref:refs/heads/main"))
+	require.NoError(t, token.Set(jwt.ExpirationKey, time.Now().Add(5*time.Minute)))
+	for k, v := range claims {
+		require.NoError(t, token.Set(k, v))
+	}
+	ti.mu.Lock()
+	key := ti.key
+	ti.mu.Unlock()
+	signed, err := jwt.Sign(token, jwa.RS256, key)
+	require.NoError(t, err)
+	return string(signed)
+}
+
+func TestProvider_VerifyToken(t *testing.T) {
+	ti := newTestIssuer(t)
+	p := NewProvider()
+	ctx := context.Background()
+
+	token, err := p.VerifyToken(ctx, ti.token(t, map[string]interface{}{jwt.AudienceKey: "https://bastion.example.com"}), ti.URL, "https://bastion.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "repo:acuteaura/tinybastion:ref:refs/heads/main", token.Subject())
+
+	_, err = p.VerifyToken(ctx, ti.token(t, map[string]interface{}{jwt.AudienceKey: "sts.amazonaws.com"}), ti.URL, "https://bastion.example.com")
+	assert.Error(t, err, "token for another audience")
+
+	_, err = p.VerifyToken(ctx, ti.token(t, nil), ti.URL, "https://bastion.example.com")
+	assert.Error(t, err, "token without audience")
+
+	_, err = p.VerifyToken(ctx, ti.token(t, map[string]interface{}{jwt.AudienceKey: "sts.amazonaws.com"}), ti.URL, "")
+	assert.NoError(t, err, "no audience required")
+
+	_, err = p.VerifyToken(ctx, ti.token(t, map[string]interface{}{jwt.ExpirationKey: time.Now().Add(-time.Minute)}), ti.URL, "")
+	assert.Error(t, err, "expired token")
+
+	_, err = p.VerifyToken(ctx, ti.token(t, map[string]interface{}{jwt.IssuerKey: "https://token.actions.githubusercontent.com"}), ti.URL, "")
+	assert.Error(t, err, "token of another issuer")
+}
+
+func TestUnverifiedIssuer(t *testing.T) {
+	ti := newTestIssuer(t)
+
+	iss, err := UnverifiedIssuer(ti.token(t, nil))
+	require.NoError(t, err)
+	assert.Equal(t, ti.URL, iss)
+
+	_, err = UnverifiedIssuer("garbage")
+	assert.Error(t, err)
+}
+
+func TestProvider_KeyRotation(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	ti := newTestIssuer(t)
+	p := NewProvider()
+	ctx := context.Background()
+
+	_, err := p.VerifyToken(ctx, ti.token(t, nil), ti.URL, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ti.fetches())
+
+	// a token signed with a new key refreshes the cached keys right away
+	ti.rotate(t, "rotated")
+	_, err = p.VerifyToken(ctx, ti.token(t, nil), ti.URL, "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, ti.fetches())
+
+	// but not again for a while, however many unknown keys show up
+	ti.rotate(t, "made-up")
+	for i := 0; i < 3; i++ {
+		_, err = p.VerifyToken(ctx, ti.token(t, nil), ti.URL, "")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 2, ti.fetches())
+
+	now = now.Add(MinRefreshInterval)
+	_, err = p.VerifyToken(ctx, ti.token(t, nil), ti.URL, "")
+	require.NoError(t, err)
+	assert.Equal(t, 3, ti.fetches())
+
+	// an unreachable issuer doesn't stop verification with the keys we have
+	ti.setFailing(true)
+	now = now.Add(time.Hour)
+	token := ti.token(t, nil)
+	_, err = p.VerifyToken(ctx, token, ti.URL, "")
+	require.NoError(t, err)
+	assert.Equal(t, 4, ti.fetches())
+	_, err = p.VerifyToken(ctx, token, ti.URL, "")
+	require.NoError(t, err)
+	assert.Equal(t, 4, ti.fetches(), "refetching expired keys is rate limited too")
+}
+
+func TestProvider_UnreachableIssuer(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	ti := newTestIssuer(t)
+	ti.setFailing(true)
+	p := NewProvider()
+	ctx := context.Background()
+
+	// without any keys cached, fetching them is rate limited all the same
+	for i := 0; i < 3; i++ {
+		_, err := p.VerifyToken(ctx, ti.token(t, nil), ti.URL, "")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 1, ti.fetches())
+
+	ti.setFailing(false)
+	now = now.Add(MinRefreshInterval)
+	_, err := p.VerifyToken(ctx, ti.token(t, nil), ti.URL, "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, ti.fetches())
+}
+
+func TestDiscoveryClient_Refresh(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	ti := newTestIssuer(t)
+	ti.cacheControl = "public, max-age=3600"
+	p := NewProvider()
+	ctx := context.Background()
+
+	// prewarmed, so verification doesn't fetch anything
+	p.discovery.Refresh(ctx, []string{ti.URL})
+	assert.Equal(t, 1, ti.fetches())
+	_, err := p.VerifyToken(ctx, ti.token(t, nil), ti.URL, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ti.fetches())
+
+	// refreshed in the background once three quarters of max-age passed
+	now = now.Add(44 * time.Minute)
+	p.discovery.Refresh(ctx, []string{ti.URL})
+	assert.Equal(t, 1, ti.fetches(), "the default TTL would have expired by now")
+	now = now.Add(time.Minute)
+	p.discovery.Refresh(ctx, []string{ti.URL})
+	assert.Equal(t, 2, ti.fetches())
+
+	// a key rotated to right after a background refresh is fetched all the same
+	ti.rotate(t, "rotated")
+	_, err = p.VerifyToken(ctx, ti.token(t, nil), ti.URL, "")
+	require.NoError(t, err)
+	assert.Equal(t, 3, ti.fetches())
+}
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"no headers", http.Header{}, DefaultCacheTTL},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=3600"}}, time.Hour},
+		{"max-age over expires", http.Header{"Cache-Control": {"max-age=3600"}, "Expires": {now.Add(2 * time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{"short max-age", http.Header{"Cache-Control": {"max-age=10"}}, MinCacheTTL},
+		{"long max-age", http.Header{"Cache-Control": {"max-age=31536000"}}, MaxCacheTTL},
+		{"no-store", http.Header{"Cache-Control": {"max-age=3600, no-store"}}, MinCacheTTL},
+		{"expires", http.Header{"Expires": {now.Add(2 * time.Hour).Format(http.TimeFormat)}}, 2 * time.Hour},
+		{"expires by server date", http.Header{"Date": {now.Add(-time.Hour).Format(http.TimeFormat)}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, 2 * time.Hour},
+		{"invalid expires", http.Header{"Expires": {"0"}}, MinCacheTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, cacheTTL(tt.header))
+		})
+	}
+}
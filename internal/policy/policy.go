@@ -0,0 +1,315 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// peer groups end up in firewall rule comments, keep them boring
+var peerGroupPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Policy is an ordered list of allow rules, evaluated against the claims of a verified token.
+// The first matching rule wins; tokens that match no rule are denied.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule allows a token if its condition matches.
+type Rule struct {
+	Name  string    `json:"name"`
+	Match Condition `json:"match"`
+	// Networks limits which routed networks the peer may reach, omit it to allow all of them.
+	// An empty list is rejected rather than guessing whether it means nothing or everything.
+	Networks []Grant `json:"networks,omitempty"`
+	// PeerGroup lets peers allowed by rules with the same group reach each other despite peer isolation
+	PeerGroup string `json:"peer_group,omitempty"`
+}
+
+// Grant allows traffic towards a network, optionally only to some ports.
+type Grant struct {
+	CIDR string `json:"cidr"`
+	// Protocol is tcp or udp, required if Ports is set
+	Protocol string   `json:"protocol,omitempty"`
+	Ports    []uint16 `json:"ports,omitempty"`
+}
+
+// Condition matches a single claim or combines nested conditions.
+// Exactly one of Claim, All or Any must be set; a claim condition needs exactly one of Exact, Glob or Regex.
+type Condition struct {
+	Claim string `json:"claim,omitempty"`
+	Exact string `json:"exact,omitempty"`
+	Glob  string `json:"glob,omitempty"`
+	Regex string `json:"regex,omitempty"`
+
+	All []Condition `json:"all,omitempty"`
+	Any []Condition `json:"any,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// Decision is the result of evaluating a policy.
+type Decision struct {
+	Allowed bool
+	// Rule is the name of the matching rule, empty if no rule matched
+	Rule string
+	// Grants are the networks of the matching rule, nil means all routed networks
+	Grants []Grant
+	// PeerGroup is the peer group of the matching rule, if any
+	PeerGroup string
+}
+
+// Load reads a JSON policy from a file and compiles it.
+func Load(filename string) (*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read policy file")
+	}
+	return Parse(data)
+}
+
+// Parse unmarshals a JSON policy and compiles it.
+func Parse(data []byte) (*Policy, error) {
+	p := &Policy{}
+	err := json.Unmarshal(data, p)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to unmarshal policy")
+	}
+	err = p.Compile()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Compile validates all rules and prepares their matchers. It must be called before Evaluate
+// on policies that were not created through Load or Parse.
+func (p *Policy) Compile() error {
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rules[%d]", i)
+		}
+		err := rule.Match.compile()
+		if err != nil {
+			return errors.Wrapf(err, "invalid rule %s", rule.Name)
+		}
+		if rule.Networks != nil && len(rule.Networks) == 0 {
+			return errors.Errorf("rule %s grants no networks, omit networks to allow all routed networks", rule.Name)
+		}
+		if rule.PeerGroup != "" && !peerGroupPattern.MatchString(rule.PeerGroup) {
+			return errors.Errorf("invalid peer group %q in rule %s", rule.PeerGroup, rule.Name)
+		}
+		for _, grant := range rule.Networks {
+			err := grant.validate()
+			if err != nil {
+				return errors.Wrapf(err, "invalid network in rule %s", rule.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks that every network granted by the policy lies within one of the routed networks,
+// a grant for anything else would let peers reach whatever the bastion can route to.
+func (p *Policy) Validate(routed []*net.IPNet) error {
+	for _, rule := range p.Rules {
+		for _, grant := range rule.Networks {
+			network, err := grant.Network()
+			if err != nil {
+				return errors.Wrapf(err, "invalid network in rule %s", rule.Name)
+			}
+			if !within(network, routed) {
+				return errors.Errorf("network %s of rule %s is not within the routed networks", grant.CIDR, rule.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Evaluate checks the claims against all rules in order.
+func (p *Policy) Evaluate(claims map[string]interface{}) Decision {
+	for _, rule := range p.Rules {
+		if rule.Match.matches(claims) {
+			return Decision{Allowed: true, Rule: rule.Name, Grants: rule.Networks, PeerGroup: rule.PeerGroup}
+		}
+	}
+	return Decision{}
+}
+
+// Network returns the parsed CIDR of the grant.
+func (g Grant) Network() (*net.IPNet, error) {
+	_, ipnet, err := net.ParseCIDR(g.CIDR)
+	return ipnet, err
+}
+
+// within tells whether network is a subnet of any of the networks
+func within(network *net.IPNet, networks []*net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	for _, outer := range networks {
+		outerOnes, outerBits := outer.Mask.Size()
+		if bits == outerBits && ones >= outerOnes && outer.Contains(network.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g Grant) validate() error {
+	_, err := g.Network()
+	if err != nil {
+		return err
+	}
+	switch g.Protocol {
+	case "":
+		if len(g.Ports) > 0 {
+			return errors.Errorf("ports for %s need a protocol", g.CIDR)
+		}
+	case "tcp", "udp":
+	default:
+		return errors.Errorf("unknown protocol %s, expected tcp or udp", g.Protocol)
+	}
+	for _, port := range g.Ports {
+		if port == 0 {
+			return errors.Errorf("invalid port 0 for %s", g.CIDR)
+		}
+	}
+	return nil
+}
+
+func (c *Condition) compile() error {
+	set := 0
+	if c.Claim != "" {
+		set++
+	}
+	if len(c.All) > 0 {
+		set++
+	}
+	if len(c.Any) > 0 {
+		set++
+	}
+	if set != 1 {
+		return errors.New("condition needs exactly one of claim, all or any")
+	}
+
+	for i := range c.All {
+		err := c.All[i].compile()
+		if err != nil {
+			return err
+		}
+	}
+	for i := range c.Any {
+		err := c.Any[i].compile()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Claim == "" {
+		return nil
+	}
+
+	matchers := 0
+	if c.Exact != "" {
+		matchers++
+	}
+	if c.Glob != "" {
+		matchers++
+		// path.Match only reports malformed patterns when matching, so do a dry run
+		_, err := path.Match(c.Glob, "")
+		if err != nil {
+			return errors.Wrapf(err, "bad glob for claim %s", c.Claim)
+		}
+	}
+	if c.Regex != "" {
+		matchers++
+		// always anchor, a partial match on e.g. a repository name is never what you want
+		re, err := regexp.Compile("^(?:" + c.Regex + ")$")
+		if err != nil {
+			return errors.Wrapf(err, "bad regex for claim %s", c.Claim)
+		}
+		c.regex = re
+	}
+	if matchers != 1 {
+		return errors.Errorf("claim %s needs exactly one of exact, glob or regex", c.Claim)
+	}
+	return nil
+}
+
+func (c *Condition) matches(claims map[string]interface{}) bool {
+	switch {
+	case len(c.All) > 0:
+		for i := range c.All {
+			if !c.All[i].matches(claims) {
+				return false
+			}
+		}
+		return true
+	case len(c.Any) > 0:
+		for i := range c.Any {
+			if c.Any[i].matches(claims) {
+				return true
+			}
+		}
+		return false
+	}
+
+	claim, ok := claims[c.Claim]
+	if !ok {
+		return false
+	}
+	for _, value := range claimValues(claim) {
+		if c.matchValue(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Condition) matchValue(value string) bool {
+	switch {
+	case c.Exact != "":
+		return value == c.Exact
+	case c.Glob != "":
+		ok, _ := path.Match(c.Glob, value)
+		return ok
+	case c.regex != nil:
+		return c.regex.MatchString(value)
+	}
+	return false
+}
+
+// claimValues flattens a claim into strings, multi-valued claims (like aud) match if any value matches
+func claimValues(claim interface{}) []string {
+	switch v := claim.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			values = append(values, ClaimString(e))
+		}
+		return values
+	default:
+		return []string{ClaimString(v)}
+	}
+}
+
+// ClaimString formats a single claim value, JSON numbers are written out in full rather than e.g. as 1.23456789e+09
+func ClaimString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,195 @@
+package policy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testClaims = map[string]interface{}{
+	"repository":       "acuteaura/tinybastion",
+	"repository_owner": "acuteaura",
+	"ref":              "refs/heads/main",
+	"environment":      "production",
+	"actor":            "someone",
+	"aud":              []interface{}{"tinybastion", "other"},
+	// numbers in JSON claims are decoded as float64
+	"run_id":      float64(1234567890),
+	"run_attempt": float64(2),
+}
+
+func TestPolicy_Evaluate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   Decision
+	}{
+		{
+			"exact match",
+			`{"rules": [{"name": "owner", "match": {"claim": "repository_owner", "exact": "acuteaura"}}]}`,
+			Decision{Allowed: true, Rule: "owner"},
+		},
+		{
+			"exact mismatch",
+			`{"rules": [{"name": "owner", "match": {"claim": "repository_owner", "exact": "someoneelse"}}]}`,
+			Decision{},
+		},
+		{
+			"missing claim",
+			`{"rules": [{"match": {"claim": "job_workflow_ref", "glob": "*"}}]}`,
+			Decision{},
+		},
+		{
+			"glob",
+			`{"rules": [{"match": {"claim": "ref", "glob": "refs/heads/*"}}]}`,
+			Decision{Allowed: true, Rule: "rules[0]"},
+		},
+		{
+			"regex is anchored",
+			`{"rules": [{"match": {"claim": "repository", "regex": "tinybastion"}}]}`,
+			Decision{},
+		},
+		{
+			"regex",
+			`{"rules": [{"match": {"claim": "repository", "regex": "acuteaura/tiny.*"}}]}`,
+			Decision{Allowed: true, Rule: "rules[0]"},
+		},
+		{
+			"multi-valued claim",
+			`{"rules": [{"match": {"claim": "aud", "exact": "tinybastion"}}]}`,
+			Decision{Allowed: true, Rule: "rules[0]"},
+		},
+		{
+			"numeric claim",
+			`{"rules": [{"match": {"all": [
+				{"claim": "run_id", "exact": "1234567890"},
+				{"claim": "run_attempt", "regex": "[0-9]+"}
+			]}}]}`,
+			Decision{Allowed: true, Rule: "rules[0]"},
+		},
+		{
+			"all",
+			`{"rules": [{"name": "prod", "match": {"all": [
+				{"claim": "repository_owner", "exact": "acuteaura"},
+				{"claim": "environment", "exact": "staging"}
+			]}}]}`,
+			Decision{},
+		},
+		{
+			"any",
+			`{"rules": [{"name": "envs", "match": {"any": [
+				{"claim": "environment", "exact": "staging"},
+				{"claim": "environment", "exact": "production"}
+			]}}]}`,
+			Decision{Allowed: true, Rule: "envs"},
+		},
+		{
+			"first match wins",
+			`{"rules": [
+				{"name": "nope", "match": {"claim": "actor", "exact": "nobody"}},
+				{"name": "first", "match": {"claim": "actor", "exact": "someone"}},
+				{"name": "second", "match": {"claim": "actor", "glob": "*"}}
+			]}`,
+			Decision{Allowed: true, Rule: "first"},
+		},
+		{
+			"empty policy denies",
+			`{}`,
+			Decision{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Parse([]byte(tt.policy))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, p.Evaluate(testClaims))
+		})
+	}
+}
+
+func TestPolicy_Compile(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+	}{
+		{"no matcher", `{"rules": [{"match": {"claim": "actor"}}]}`},
+		{"two matchers", `{"rules": [{"match": {"claim": "actor", "exact": "a", "glob": "b"}}]}`},
+		{"empty condition", `{"rules": [{"match": {}}]}`},
+		{"empty all", `{"rules": [{"match": {"all": []}}]}`},
+		{"claim and any", `{"rules": [{"match": {"claim": "actor", "exact": "a", "any": [{"claim": "actor", "exact": "b"}]}}]}`},
+		{"bad regex", `{"rules": [{"match": {"claim": "actor", "regex": "("}}]}`},
+		{"bad glob", `{"rules": [{"match": {"claim": "actor", "glob": "["}}]}`},
+		{"bad nested", `{"rules": [{"match": {"any": [{"claim": "actor"}]}}]}`},
+		{"bad network", `{"rules": [{"match": {"claim": "actor", "exact": "a"}, "networks": [{"cidr": "10.0.0.0/33"}]}]}`},
+		{"ports without protocol", `{"rules": [{"match": {"claim": "actor", "exact": "a"}, "networks": [{"cidr": "10.0.0.0/8", "ports": [22]}]}]}`},
+		{"bad peer group", `{"rules": [{"match": {"claim": "actor", "exact": "a"}, "peer_group": "a\"b"}]}`},
+		{"empty networks", `{"rules": [{"match": {"claim": "actor", "exact": "a"}, "networks": []}]}`},
+		{"bad protocol", `{"rules": [{"match": {"claim": "actor", "exact": "a"}, "networks": [{"cidr": "10.0.0.0/8", "protocol": "icmp"}]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.policy))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestPolicy_EvaluateGrants(t *testing.T) {
+	p, err := Parse([]byte(`{"rules": [
+		{"name": "db", "match": {"claim": "environment", "exact": "production"}, "networks": [
+			{"cidr": "10.10.0.0/16", "protocol": "tcp", "ports": [5432]}
+		]},
+		{"name": "everything", "match": {"claim": "actor", "glob": "*"}, "peer_group": "runners"}
+	]}`))
+	assert.NoError(t, err)
+
+	assert.Equal(t, Decision{Allowed: true, Rule: "db", Grants: []Grant{
+		{CIDR: "10.10.0.0/16", Protocol: "tcp", Ports: []uint16{5432}},
+	}}, p.Evaluate(testClaims))
+
+	assert.Equal(t, Decision{Allowed: true, Rule: "everything", PeerGroup: "runners"}, p.Evaluate(map[string]interface{}{"actor": "someone"}))
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	routed := []*net.IPNet{mustParseCIDR("192.168.0.0/16"), mustParseCIDR("fd12::/48")}
+	tests := []struct {
+		name    string
+		cidr    string
+		wantErr bool
+	}{
+		{"inside", "192.168.10.5/32", false},
+		{"routed network itself", "192.168.0.0/16", false},
+		{"ipv6", "fd12:0:0:1::/64", false},
+		{"everything", "0.0.0.0/0", true},
+		{"metadata service", "169.254.169.254/32", true},
+		{"supernet", "192.0.0.0/8", true},
+		{"other family", "::/0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Parse([]byte(`{"rules": [{"match": {"claim": "actor", "glob": "*"}, "networks": [{"cidr": "` + tt.cidr + `"}]}]}`))
+			require.NoError(t, err)
+			err = p.Validate(routed)
+			if tt.wantErr {
+				assert.ErrorContains(t, err, "is not within the routed networks")
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	// rules without networks get all routed networks, there is nothing to check
+	p, err := Parse([]byte(`{"rules": [{"match": {"claim": "actor", "glob": "*"}}]}`))
+	require.NoError(t, err)
+	assert.NoError(t, p.Validate(nil))
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
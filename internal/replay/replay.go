@@ -0,0 +1,110 @@
+// Package replay remembers which tokens were used already, until they expire
+package replay
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrReplayed is returned for a token that was already used for something else
+	ErrReplayed = errors.New("token was already used")
+	// ErrFull is returned when the store can't remember another token before some expire
+	ErrFull = errors.New("too many unexpired tokens")
+)
+
+// DefaultTTL is how long tokens without an expiry are remembered
+const DefaultTTL = time.Hour
+
+// make it possible to test expiry without waiting
+var timeNow = time.Now
+
+type entry struct {
+	id      string
+	binding string
+	expires time.Time
+}
+
+// queue is a min-heap of entries by expiry
+type queue []*entry
+
+func (q queue) Len() int           { return len(q) }
+func (q queue) Less(i, j int) bool { return q[i].expires.Before(q[j].expires) }
+func (q queue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *queue) Push(x interface{}) {
+	*q = append(*q, x.(*entry))
+}
+
+func (q *queue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return e
+}
+
+// Store binds token IDs to what they were first used for, e.g. a public key.
+// It holds at most a fixed number of tokens, so memory stays bounded however many are presented.
+type Store struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*entry
+	// expiring orders the entries by expiry, so using a token stays O(log n) however full the store is
+	expiring queue
+}
+
+// New creates a store for at most size unexpired tokens
+func New(size int) *Store {
+	return &Store{
+		size:    size,
+		entries: make(map[string]*entry),
+	}
+}
+
+// Use records that the token id is used for binding until expires, zero for DefaultTTL.
+// Using it again for the same binding is fine, e.g. to retry a request, anything else fails with ErrReplayed.
+// If the store is full of unexpired tokens, ErrFull is returned rather than forgetting one of them.
+func (s *Store) Use(id string, binding string, expires time.Time) error {
+	now := timeNow()
+	if expires.IsZero() {
+		expires = now.Add(DefaultTTL)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purge(now)
+	if e, ok := s.entries[id]; ok {
+		if e.binding != binding {
+			return ErrReplayed
+		}
+		return nil
+	}
+
+	if len(s.entries) >= s.size {
+		return ErrFull
+	}
+	e := &entry{id: id, binding: binding, expires: expires}
+	s.entries[id] = e
+	heap.Push(&s.expiring, e)
+	return nil
+}
+
+// Len returns the number of tokens remembered, including expired ones not purged yet
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// purge forgets expired tokens, it must be called with mu held
+func (s *Store) purge(now time.Time) {
+	for len(s.expiring) > 0 && !now.Before(s.expiring[0].expires) {
+		e := heap.Pop(&s.expiring).(*entry)
+		delete(s.entries, e.id)
+	}
+}
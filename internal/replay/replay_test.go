@@ -0,0 +1,55 @@
+package replay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	s := New(2)
+	assert.NoError(t, s.Use("a", "key1", now.Add(5*time.Minute)))
+	// retrying with the same token is fine, using it for another key isn't
+	assert.NoError(t, s.Use("a", "key1", now.Add(5*time.Minute)))
+	assert.ErrorIs(t, s.Use("a", "key2", now.Add(5*time.Minute)), ErrReplayed)
+
+	assert.NoError(t, s.Use("b", "key2", now.Add(10*time.Minute)))
+	assert.ErrorIs(t, s.Use("c", "key3", now.Add(10*time.Minute)), ErrFull)
+
+	// expired tokens make room
+	now = now.Add(5 * time.Minute)
+	assert.NoError(t, s.Use("c", "key3", now.Add(10*time.Minute)))
+	assert.Equal(t, 2, s.Len())
+
+	// without an expiry tokens are kept for DefaultTTL
+	s = New(1)
+	assert.NoError(t, s.Use("d", "key1", time.Time{}))
+	now = now.Add(DefaultTTL - time.Second)
+	assert.ErrorIs(t, s.Use("d", "key2", time.Time{}), ErrReplayed)
+	now = now.Add(time.Second)
+	assert.NoError(t, s.Use("d", "key2", time.Time{}))
+}
+
+func TestStore_ExpiryOrder(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	// tokens expire in their own order, not in the order they were used
+	s := New(3)
+	assert.NoError(t, s.Use("late", "key1", now.Add(30*time.Minute)))
+	assert.NoError(t, s.Use("early", "key2", now.Add(10*time.Minute)))
+	assert.NoError(t, s.Use("middle", "key3", now.Add(20*time.Minute)))
+
+	now = now.Add(15 * time.Minute)
+	assert.NoError(t, s.Use("early", "key4", time.Time{}), "expired tokens make room and can be used again")
+	assert.Equal(t, 3, s.Len())
+	assert.ErrorIs(t, s.Use("late", "key4", time.Time{}), ErrReplayed)
+	assert.ErrorIs(t, s.Use("middle", "key4", time.Time{}), ErrReplayed)
+	assert.ErrorIs(t, s.Use("new", "key5", time.Time{}), ErrFull)
+}
@@ -0,0 +1,241 @@
+// Package webhook POSTs peer lifecycle events to configured URLs. Every URL has its own bounded queue
+// and worker, so a slow or failing receiver neither blocks the bastion nor delays other receivers.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/acuteaura/tinybastion/internal/metrics"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	EventPeerCreated = "peer.created"
+	// EventPeerHandshake is sent once, for the first handshake of a peer
+	EventPeerHandshake = "peer.handshake"
+	// EventPeerStale is sent when a peer that handshaked before stops doing so, it is removed soon after
+	EventPeerStale   = "peer.stale"
+	EventPeerRemoved = "peer.removed"
+)
+
+const (
+	// SignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the body, keyed with the shared secret
+	SignatureHeader = "X-Tinybastion-Signature"
+	EventHeader     = "X-Tinybastion-Event"
+)
+
+type Event struct {
+	// ID is the same for all receivers and retries, receivers can use it to deduplicate
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	PublicKey string    `json:"public_key"`
+	IPs       []string  `json:"ips,omitempty"`
+
+	Subject    string `json:"sub,omitempty"`
+	Issuer     string `json:"iss,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	Workflow   string `json:"workflow,omitempty"`
+	RunID      string `json:"run_id,omitempty"`
+	Actor      string `json:"actor,omitempty"`
+
+	Expires *time.Time `json:"expires,omitempty"`
+	// Reason is why a peer was removed
+	Reason string `json:"reason,omitempty"`
+}
+
+type Options struct {
+	// Secret keys the signature of every request
+	Secret string
+	// QueueSize is how many events wait per URL before new ones are dropped, 100 if zero
+	QueueSize int
+	// MaxAttempts per event and URL, 5 if zero
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubled for every further one. 1s if zero.
+	Backoff time.Duration
+	// Timeout of a single request, 10s if zero
+	Timeout time.Duration
+}
+
+const (
+	outcomeDelivered = "delivered"
+	outcomeFailed    = "failed"
+	outcomeDropped   = "dropped"
+)
+
+var deliveries = metrics.NewCounterVec("tinybastion_webhook_events_total", "Webhook events by outcome, failed ones are counted after the last attempt.", "outcome",
+	outcomeDelivered, outcomeFailed, outcomeDropped)
+
+// Notifier sends events to all configured URLs. A nil *Notifier discards everything, so webhooks can be left unconfigured.
+type Notifier struct {
+	endpoints []*endpoint
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+type endpoint struct {
+	url    string
+	secret []byte
+	queue  chan Event
+	client *http.Client
+
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// New starts a worker per URL, stop them with Close
+func New(urls []string, opts Options) *Notifier {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 100
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{cancel: cancel}
+	for _, url := range urls {
+		ep := &endpoint{
+			url:         url,
+			secret:      []byte(opts.Secret),
+			queue:       make(chan Event, opts.QueueSize),
+			client:      &http.Client{Timeout: opts.Timeout},
+			maxAttempts: opts.MaxAttempts,
+			backoff:     opts.Backoff,
+		}
+		n.endpoints = append(n.endpoints, ep)
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			ep.run(ctx)
+		}()
+	}
+	return n
+}
+
+// Notify queues an event for all URLs without blocking, it is dropped for URLs whose queue is full
+func (n *Notifier) Notify(e Event) {
+	if n == nil {
+		return
+	}
+	if e.ID == "" {
+		e.ID = uuid.New().String()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, ep := range n.endpoints {
+		select {
+		case ep.queue <- e:
+		default:
+			deliveries.Inc(outcomeDropped)
+			slog.Warn("webhook queue full, dropping event", "url", ep.url, "event", e.Type, "event_id", e.ID)
+		}
+	}
+}
+
+// Close stops all workers, queued events are dropped
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	n.cancel()
+	n.wg.Wait()
+}
+
+func (ep *endpoint) run(ctx context.Context) {
+	for {
+		select {
+		case e := <-ep.queue:
+			ep.deliver(ctx, e)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver tries to send an event until it is accepted, the receiver rejects it or the attempts are used up
+func (ep *endpoint) deliver(ctx context.Context, e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("unable to marshal webhook event", "event", e.Type, "error", err)
+		return
+	}
+
+	backoff := ep.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := ep.send(ctx, e.Type, body)
+		if err == nil {
+			deliveries.Inc(outcomeDelivered)
+			return
+		}
+		if !retry || attempt >= ep.maxAttempts {
+			deliveries.Inc(outcomeFailed)
+			slog.Error("webhook delivery failed", "url", ep.url, "event", e.Type, "event_id", e.ID, "attempts", attempt, "error", err)
+			return
+		}
+		slog.Warn("webhook delivery failed, retrying", "url", ep.url, "event", e.Type, "event_id", e.ID, "attempt", attempt, "error", err)
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send makes a single attempt, retry is false if the receiver rejected the event itself
+func (ep *endpoint) send(ctx context.Context, eventType string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, eventType)
+	req.Header.Set(SignatureHeader, Sign(ep.secret, body))
+
+	res, err := ep.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+	err = errors.Errorf("unexpected status code %d", res.StatusCode)
+	// other client errors won't go away by sending the same event again
+	retry = res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusRequestTimeout
+	return retry, err
+}
+
+// Sign computes the value of SignatureHeader for a body
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the SignatureHeader of a request body, for receivers
+func Verify(secret []byte, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
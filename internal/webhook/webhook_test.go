@@ -0,0 +1,124 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiver records the events it accepts, after failing the given number of requests
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	status   int
+	requests int
+	events   chan Event
+}
+
+func newReceiver(t *testing.T, failures int, status int) (*receiver, *httptest.Server) {
+	r := &receiver{failures: failures, status: status, events: make(chan Event, 10)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.True(t, Verify([]byte("secret"), body, req.Header.Get(SignatureHeader)))
+
+		r.mu.Lock()
+		r.requests++
+		fail := r.requests <= r.failures
+		r.mu.Unlock()
+		if fail {
+			w.WriteHeader(r.status)
+			return
+		}
+
+		var e Event
+		require.NoError(t, json.Unmarshal(body, &e))
+		assert.Equal(t, e.Type, req.Header.Get(EventHeader))
+		r.events <- e
+	}))
+	t.Cleanup(srv.Close)
+	return r, srv
+}
+
+func (r *receiver) requestCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests
+}
+
+func TestNotifier_Retries(t *testing.T) {
+	r, srv := newReceiver(t, 2, http.StatusServiceUnavailable)
+
+	n := New([]string{srv.URL}, Options{Secret: "secret", Backoff: time.Millisecond})
+	defer n.Close()
+	n.Notify(Event{Type: EventPeerCreated, PublicKey: "key"})
+
+	select {
+	case e := <-r.events:
+		assert.Equal(t, EventPeerCreated, e.Type)
+		assert.Equal(t, "key", e.PublicKey)
+		assert.NotEmpty(t, e.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+	assert.Equal(t, 3, r.requestCount())
+}
+
+func TestNotifier_NoRetryOnClientError(t *testing.T) {
+	r, srv := newReceiver(t, 1, http.StatusBadRequest)
+
+	n := New([]string{srv.URL}, Options{Secret: "secret", Backoff: time.Millisecond})
+	defer n.Close()
+	n.Notify(Event{Type: EventPeerCreated})
+	n.Notify(Event{Type: EventPeerRemoved})
+
+	select {
+	case e := <-r.events:
+		// the first one was rejected and not sent again
+		assert.Equal(t, EventPeerRemoved, e.Type)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+	assert.Equal(t, 2, r.requestCount())
+}
+
+func TestNotifier_QueueFull(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	n := New([]string{srv.URL}, Options{Secret: "secret", QueueSize: 1})
+	defer n.Close()
+
+	dropped := deliveries.Value(outcomeDropped)
+	done := make(chan struct{})
+	go func() {
+		// one in flight, one queued, the rest is dropped without blocking
+		for i := 0; i < 5; i++ {
+			n.Notify(Event{Type: EventPeerCreated})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify blocked")
+	}
+	assert.GreaterOrEqual(t, deliveries.Value(outcomeDropped)-dropped, float64(3))
+}
+
+func TestNotifier_Nil(t *testing.T) {
+	var n *Notifier
+	n.Notify(Event{Type: EventPeerCreated})
+	n.Close()
+}
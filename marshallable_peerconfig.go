@@ -6,7 +6,6 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"net"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -16,34 +15,40 @@ type MarshallablePeerConfig struct {
 }
 
 func (m *MarshallablePeerConfig) MarshalJSON() ([]byte, error) {
+	allowedIPs := make([]string, 0, len(m.P.AllowedIPs))
+	for _, ipNet := range m.P.AllowedIPs {
+		allowedIPs = append(allowedIPs, ipNet.String())
+	}
+
 	out := struct {
 		Endpoint                    string
-		Gateway                     string
+		Gateways                    []string
 		PresharedKey                string
 		PersistentKeepaliveInterval int
 		PublicKey                   string
-		AllowedIP                   string
+		AllowedIPs                  []string
+		RoutedNetworks              []string
 	}{
-		Endpoint:                    fmt.Sprintf("%s:%d", m.BSI.EndpointHost, m.BSI.EndpointPort),
-		Gateway:                     m.BSI.GatewayIP,
+		Endpoint:                    net.JoinHostPort(m.BSI.EndpointHost, strconv.Itoa(m.BSI.EndpointPort)),
+		Gateways:                    m.BSI.GatewayIPs,
 		PresharedKey:                m.P.PresharedKey.String(),
 		PersistentKeepaliveInterval: int(m.P.PersistentKeepaliveInterval.Seconds()),
 		PublicKey:                   m.BSI.PublicKey,
-		// FIXME: this is assuming we only have a single ip, which is assuming a lot..
-		AllowedIP: m.P.AllowedIPs[0].String(),
+		AllowedIPs:                  allowedIPs,
+		RoutedNetworks:              m.BSI.RoutedNetworks,
 	}
 	return json.Marshal(&out)
 }
 
 func (m *MarshallablePeerConfig) UnmarshalJSON(bytes []byte) error {
-	//TODO implement for client
 	var raw struct {
 		Endpoint                    string
-		Gateway                     string
+		Gateways                    []string
 		PresharedKey                string
 		PersistentKeepaliveInterval int
 		PublicKey                   string
-		AllowedIP                   string
+		AllowedIPs                  []string
+		RoutedNetworks              []string
 	}
 
 	err := json.Unmarshal(bytes, &raw)
@@ -51,18 +56,21 @@ func (m *MarshallablePeerConfig) UnmarshalJSON(bytes []byte) error {
 		return err
 	}
 
-	hostAndPort := strings.Split(raw.Endpoint, ":")
-	host := hostAndPort[0]
-	port, err := strconv.ParseInt(hostAndPort[1], 10, 32)
+	host, portStr, err := net.SplitHostPort(raw.Endpoint)
+	if err != nil {
+		return fmt.Errorf("could not parse endpoint: %+v", err)
+	}
+	port, err := strconv.ParseInt(portStr, 10, 32)
 	if err != nil {
 		return fmt.Errorf("could not parse port number: %+v", err)
 	}
 
 	m.BSI = BastionServerInfo{
-		EndpointHost: host,
-		EndpointPort: int(port),
-		GatewayIP:    raw.Gateway,
-		PublicKey:    raw.PublicKey,
+		EndpointHost:   host,
+		EndpointPort:   int(port),
+		GatewayIPs:     raw.Gateways,
+		PublicKey:      raw.PublicKey,
+		RoutedNetworks: raw.RoutedNetworks,
 	}
 
 	preSharedKey, err := wgtypes.ParseKey(raw.PresharedKey)
@@ -70,18 +78,20 @@ func (m *MarshallablePeerConfig) UnmarshalJSON(bytes []byte) error {
 		return fmt.Errorf("could not parse pre shared key: %+v", err)
 	}
 
-	_, ipNet, err := net.ParseCIDR(raw.AllowedIP)
-	if err != nil {
-		return fmt.Errorf("could not parse allowed IP as CIDR: %+v", err)
+	allowedIPs := make([]net.IPNet, 0, len(raw.AllowedIPs))
+	for _, allowedIP := range raw.AllowedIPs {
+		_, ipNet, err := net.ParseCIDR(allowedIP)
+		if err != nil {
+			return fmt.Errorf("could not parse allowed IP as CIDR: %+v", err)
+		}
+		allowedIPs = append(allowedIPs, *ipNet)
 	}
 
 	persistentKeepaliveInterval := time.Second * time.Duration(raw.PersistentKeepaliveInterval)
 	m.P = wgtypes.PeerConfig{
 		PresharedKey:                &preSharedKey,
 		PersistentKeepaliveInterval: &persistentKeepaliveInterval,
-		AllowedIPs: []net.IPNet{
-			*ipNet,
-		},
+		AllowedIPs:                  allowedIPs,
 	}
 
 	return nil
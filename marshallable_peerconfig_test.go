@@ -0,0 +1,45 @@
+package tinybastion
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestMarshallablePeerConfig(t *testing.T) {
+	psk, err := wgtypes.GenerateKey()
+	require.NoError(t, err)
+	keepalive := 30 * time.Second
+
+	mpc := MarshallablePeerConfig{
+		P: wgtypes.PeerConfig{
+			PresharedKey:                &psk,
+			PersistentKeepaliveInterval: &keepalive,
+			AllowedIPs: []net.IPNet{
+				{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(32, 32)},
+				{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(128, 128)},
+			},
+		},
+		BSI: BastionServerInfo{
+			EndpointHost:   "2001:db8::1",
+			EndpointPort:   5555,
+			GatewayIPs:     []string{"10.0.0.1", "fd00::1"},
+			PublicKey:      "0KH+kIcJtdVD8t00CaGi+iWi5A81YuRHicG06+XsTWo=",
+			RoutedNetworks: []string{"192.168.0.0/16"},
+		},
+	}
+
+	data, err := json.Marshal(&mpc)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"Endpoint":"[2001:db8::1]:5555"`)
+	assert.Contains(t, string(data), `"AllowedIPs":["10.0.0.2/32","fd00::2/128"]`)
+
+	mpc2 := MarshallablePeerConfig{}
+	require.NoError(t, json.Unmarshal(data, &mpc2))
+	assert.Equal(t, mpc, mpc2)
+}
@@ -0,0 +1,78 @@
+package tinybastion
+
+import (
+	"log/slog"
+
+	"github.com/acuteaura/tinybastion/internal/metrics"
+)
+
+// reasons a peer was removed
+const (
+	removedStale    = "stale"
+	removedExpired  = "expired"
+	removedDeleted  = "deleted"
+	removedEvicted  = "evicted"
+	removedRollback = "rollback"
+	// only audited, these peers were never on the device
+	removedNotRestored = "not_restored"
+)
+
+// outcomes of a tunnel create request
+const (
+	outcomeSuccess       = "success"
+	outcomeAuthFailure   = "auth_failure"
+	outcomePolicyDenied  = "policy_denied"
+	outcomeBadRequest    = "bad_request"
+	outcomeConflict      = "conflict"
+	outcomeIPAMExhausted = "ipam_exhausted"
+	outcomeReplayed      = "replayed"
+	outcomeRunLimit      = "run_limit"
+	outcomeError         = "error"
+)
+
+var (
+	tunnelCreateRequests = metrics.NewCounterVec("tinybastion_tunnel_create_requests_total", "Tunnel create requests by outcome.", "outcome",
+		outcomeSuccess, outcomeAuthFailure, outcomePolicyDenied, outcomeBadRequest, outcomeConflict, outcomeIPAMExhausted, outcomeReplayed, outcomeRunLimit, outcomeError)
+	cleanupRuns  = metrics.NewCounter("tinybastion_cleanup_runs_total", "Runs of the handshake based peer cleanup.")
+	peersRemoved = metrics.NewCounterVec("tinybastion_peers_removed_total", "Removed peers by reason.", "reason",
+		removedStale, removedExpired, removedDeleted, removedEvicted, removedRollback)
+)
+
+var _ metrics.Collector = &Bastion{}
+
+// Collect reports the current peers and address usage, register the bastion with a metrics.Registry to expose them
+func (b *Bastion) Collect() []metrics.Family {
+	activePeers := metrics.Family{Name: "tinybastion_active_peers", Help: "Peers currently issued.", Type: metrics.TypeGauge}
+	addresses := metrics.Family{Name: "tinybastion_ipam_addresses", Help: "Tunnel addresses per prefix, used ones include the gateway and reserved addresses.", Type: metrics.TypeGauge}
+	receiveBytes := metrics.Family{Name: "tinybastion_peer_receive_bytes_total", Help: "Bytes received from a peer.", Type: metrics.TypeCounter}
+	transmitBytes := metrics.Family{Name: "tinybastion_peer_transmit_bytes_total", Help: "Bytes sent to a peer.", Type: metrics.TypeCounter}
+
+	b.peersMu.Lock()
+	activePeers.Samples = []metrics.Sample{{Value: float64(len(b.peers))}}
+	for _, prefix := range b.allPrefixes() {
+		p := b.ipam.PrefixFrom(prefix.String())
+		if p == nil {
+			continue
+		}
+		usage := p.Usage()
+		addresses.Samples = append(addresses.Samples,
+			metrics.Sample{Labels: map[string]string{"prefix": prefix.String(), "state": "used"}, Value: float64(usage.AcquiredIPs)},
+			metrics.Sample{Labels: map[string]string{"prefix": prefix.String(), "state": "free"}, Value: float64(usage.AvailableIPs - usage.AcquiredIPs)},
+		)
+	}
+	b.peersMu.Unlock()
+
+	families := []metrics.Family{activePeers, addresses}
+
+	device, err := b.Device.Device()
+	if err != nil {
+		slog.Error("unable to read device for metrics", "error", err)
+		return families
+	}
+	for _, p := range device.Peers {
+		labels := map[string]string{"public_key": p.PublicKey.String()}
+		receiveBytes.Samples = append(receiveBytes.Samples, metrics.Sample{Labels: labels, Value: float64(p.ReceiveBytes)})
+		transmitBytes.Samples = append(transmitBytes.Samples, metrics.Sample{Labels: labels, Value: float64(p.TransmitBytes)})
+	}
+	return append(families, receiveBytes, transmitBytes)
+}
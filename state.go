@@ -0,0 +1,215 @@
+package tinybastion
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/acuteaura/tinybastion/internal/audit"
+	"github.com/acuteaura/tinybastion/internal/policy"
+	"github.com/metal-stack/go-ipam"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// bastionState is what we persist to Config.StateFile, it contains the PSKs and must stay private
+type bastionState struct {
+	Peers []peerState `json:"peers"`
+}
+
+type peerState struct {
+	PublicKey    MarshallableKey        `json:"public_key"`
+	PresharedKey MarshallableKey        `json:"preshared_key"`
+	IPs          []string               `json:"ips"`
+	Pool         string                 `json:"pool,omitempty"`
+	Owner        Identity               `json:"owner"`
+	Claims       map[string]interface{} `json:"claims,omitempty"`
+	Grants       []policy.Grant         `json:"grants,omitempty"`
+	PeerGroup    string                 `json:"peer_group,omitempty"`
+	Created      time.Time              `json:"created"`
+	Expires      time.Time              `json:"expires"`
+}
+
+// loadOrCreatePrivateKey reads a key in `wg genkey` format, generating and writing one with 0600 permissions if the file is absent
+func loadOrCreatePrivateKey(filename string) (wgtypes.Key, error) {
+	data, err := os.ReadFile(filename)
+	if err == nil {
+		key, err := wgtypes.ParseKey(strings.TrimSpace(string(data)))
+		if err != nil {
+			return wgtypes.Key{}, errors.Wrapf(err, "unable to parse private key from %s", filename)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return wgtypes.Key{}, errors.Wrap(err, "unable to read private key")
+	}
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return wgtypes.Key{}, err
+	}
+
+	// O_EXCL, in case someone else got there first we'd rather fail than overwrite their key
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return wgtypes.Key{}, errors.Wrap(err, "unable to create private key file")
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(key.String() + "\n")
+	if err != nil {
+		return wgtypes.Key{}, errors.Wrap(err, "unable to write private key file")
+	}
+
+	slog.Info("generated new bastion key", "file", filename)
+	return key, nil
+}
+
+// restorePeers re-adds peers from the state file to the device, peers that no longer fit the config are dropped
+func (b *Bastion) restorePeers() error {
+	if b.Config.StateFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(b.Config.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to read state file")
+	}
+
+	state := bastionState{}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return errors.Wrap(err, "unable to unmarshal state file")
+	}
+
+	b.peersMu.Lock()
+	defer b.peersMu.Unlock()
+
+	peerConfigs := make([]wgtypes.PeerConfig, 0, len(state.Peers))
+	for _, ps := range state.Peers {
+		if ps.Owner.Run == "" {
+			// state files from before owners were bound to their run, requests of the run own the peer now
+			ps.Owner.Run = runOf(ps.Claims)
+		}
+		ips, err := b.acquireSpecificIPs(ps.IPs, ps.Pool)
+		if err != nil {
+			slog.Warn("not restoring peer", "peer", ps.PublicKey.K.String(), "error", err)
+			dropped := &peer{owner: ps.Owner, claims: ps.Claims, created: ps.Created, expires: ps.Expires}
+			entry := dropped.auditEntry(context.Background(), audit.EventEnd, ps.PublicKey.K, removedNotRestored)
+			entry.IPs = ps.IPs
+			err = b.audit.Append(entry)
+			if err != nil {
+				slog.Error("unable to audit dropped peer", "peer", ps.PublicKey.K.String(), "error", err)
+			}
+			continue
+		}
+		p := &peer{ips: ips, pool: ps.Pool, psk: ps.PresharedKey.K, owner: ps.Owner, claims: ps.Claims, grants: ps.Grants, group: ps.PeerGroup, created: ps.Created, expires: ps.Expires}
+		b.peers[ps.PublicKey.K] = p
+		peerConfigs = append(peerConfigs, b.peerConfig(ps.PublicKey.K, p))
+	}
+
+	err = b.Device.Configure(wgtypes.Config{Peers: peerConfigs})
+	if err != nil {
+		return errors.Wrap(err, "unable to restore peers")
+	}
+
+	slog.Info("restored peers", "restored", len(peerConfigs), "total", len(state.Peers), "file", b.Config.StateFile)
+
+	// write back what we actually restored
+	b.saveState()
+	return nil
+}
+
+// acquireSpecificIPs reserves previously issued addresses, a peer needs exactly one per prefix of its pool
+func (b *Bastion) acquireSpecificIPs(addrs []string, pool string) ([]*ipam.IP, error) {
+	prefixes, err := b.poolPrefixes(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]*ipam.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		prefix, ok := prefixIn(prefixes, net.ParseIP(addr))
+		if !ok {
+			b.releaseIPs(ips)
+			return nil, errors.Errorf("%s is not in any prefix of its pool", addr)
+		}
+		ip, err := b.ipam.AcquireSpecificIP(prefix.String(), addr)
+		if err != nil {
+			b.releaseIPs(ips)
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) != len(prefixes) {
+		b.releaseIPs(ips)
+		return nil, errors.Errorf("expected %d addresses, got %d", len(prefixes), len(ips))
+	}
+	return ips, nil
+}
+
+// saveState must be called with peersMu held, failures are logged since the peers themselves are fine
+func (b *Bastion) saveState() {
+	if b.Config.StateFile == "" {
+		return
+	}
+
+	state := bastionState{Peers: make([]peerState, 0, len(b.peers))}
+	for key, p := range b.peers {
+		ips := make([]string, 0, len(p.ips))
+		for _, ip := range p.ips {
+			ips = append(ips, ip.IP.String())
+		}
+		state.Peers = append(state.Peers, peerState{
+			PublicKey:    MarshallableKey{K: key},
+			PresharedKey: MarshallableKey{K: p.psk},
+			IPs:          ips,
+			Pool:         p.pool,
+			Owner:        p.owner,
+			Claims:       p.claims,
+			Grants:       p.grants,
+			PeerGroup:    p.group,
+			Created:      p.created,
+			Expires:      p.expires,
+		})
+	}
+
+	err := writeFileAtomic(b.Config.StateFile, &state)
+	if err != nil {
+		slog.Error("unable to persist state", "error", err)
+	}
+}
+
+// writeFileAtomic writes JSON to a 0600 temp file next to the target and renames it into place
+func writeFileAtomic(filename string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,102 @@
+package tinybastion
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestLoadOrCreatePrivateKey(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "private.key")
+
+	key, err := loadOrCreatePrivateKey(filename)
+	require.NoError(t, err)
+
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	reloaded, err := loadOrCreatePrivateKey(filename)
+	require.NoError(t, err)
+	assert.Equal(t, key, reloaded)
+}
+
+func TestBastion_RestorePeers(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	b, _ := newTestBastion(t, "10.0.0.0/29")
+	b.Config.StateFile = stateFile
+
+	issued := make(map[wgtypes.Key]*wgtypes.PeerConfig)
+	for i := 0; i < 3; i++ {
+		key := generateKey(t)
+		pc, err := b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity})
+		require.NoError(t, err)
+		issued[key] = pc
+	}
+	removed := generateKey(t)
+	_, err := b.AddPeer(context.Background(), removed, PeerOptions{Owner: testIdentity})
+	require.NoError(t, err)
+	require.NoError(t, b.RemovePeer(context.Background(), removed))
+
+	device := NewMemoryDevice("test")
+	restarted, err := NewWithDevice(Config{
+		DeviceName:           "test",
+		PersistentKeepalive:  30,
+		CIDR:                 "10.0.0.0/29",
+		DisablePeerIsolation: true,
+		StateFile:            stateFile,
+	}, device, nil)
+	require.NoError(t, err)
+
+	peers := devicePeers(t, device)
+	assert.Len(t, peers, len(issued))
+	for key, pc := range issued {
+		restored, ok := peers[key]
+		require.True(t, ok)
+		assert.Equal(t, pc.AllowedIPs, restored.AllowedIPs)
+		assert.Equal(t, *pc.PresharedKey, restarted.peers[key].psk)
+		assert.Equal(t, testIdentity, restarted.peers[key].owner)
+	}
+
+	// restored addresses must not be handed out again
+	pc, err := restarted.AddPeer(context.Background(), generateKey(t), PeerOptions{Owner: testIdentity})
+	require.NoError(t, err)
+	for _, issuedPC := range issued {
+		assert.NotEqual(t, issuedPC.AllowedIPs, pc.AllowedIPs)
+	}
+}
+
+func TestBastion_RestorePeersWithoutRun(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	// the owner of a peer didn't record its run before, only the claims did
+	b, _ := newTestBastion(t, "10.0.0.0/29")
+	b.Config.StateFile = stateFile
+	key := generateKey(t)
+	_, err := b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity, Claims: map[string]interface{}{"run_id": "42", "run_attempt": "1"}})
+	require.NoError(t, err)
+	data, err := os.ReadFile(stateFile)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), `"run"`)
+
+	device := NewMemoryDevice("test")
+	restarted, err := NewWithDevice(Config{
+		DeviceName:           "test",
+		PersistentKeepalive:  30,
+		CIDR:                 "10.0.0.0/29",
+		DisablePeerIsolation: true,
+		StateFile:            stateFile,
+	}, device, nil)
+	require.NoError(t, err)
+
+	owner := testIdentity
+	owner.Run = "42/1"
+	require.NoError(t, restarted.RemoveOwnedPeer(context.Background(), key, owner))
+	assert.Empty(t, devicePeers(t, device))
+}
@@ -0,0 +1,75 @@
+package tinybastion
+
+import (
+	"github.com/acuteaura/tinybastion/internal/webhook"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// webhookEvent describes a peer for webhook receivers, reason is only set for webhook.EventPeerRemoved
+func (p *peer) webhookEvent(eventType string, key wgtypes.Key, reason string) webhook.Event {
+	e := webhook.Event{
+		Type:       eventType,
+		Time:       clock.Now(),
+		PublicKey:  key.String(),
+		IPs:        p.addresses(),
+		Subject:    p.owner.Subject,
+		Issuer:     p.owner.Issuer,
+		Repository: claimString(p.claims, "repository"),
+		Workflow:   claimString(p.claims, "workflow"),
+		RunID:      claimString(p.claims, "run_id"),
+		Actor:      claimString(p.claims, "actor"),
+		Reason:     reason,
+	}
+	if !p.expires.IsZero() {
+		expires := p.expires
+		e.Expires = &expires
+	}
+	return e
+}
+
+// SetWebhooks replaces the webhook receivers, events still queued for the old ones are dropped
+func (b *Bastion) SetWebhooks(urls []string, secret string) {
+	webhooks := newNotifier(urls, secret)
+
+	b.peersMu.Lock()
+	old := b.webhooks
+	b.webhooks = webhooks
+	b.Config.WebhookURLs = urls
+	b.Config.WebhookSecret = secret
+	b.peersMu.Unlock()
+
+	old.Close()
+}
+
+// newNotifier returns nil without URLs, which discards all events
+func newNotifier(urls []string, secret string) *webhook.Notifier {
+	if len(urls) == 0 {
+		return nil
+	}
+	return webhook.New(urls, webhook.Options{Secret: secret})
+}
+
+// notifyHandshakes sends webhooks for peers that handshaked for the first time or stopped doing so.
+// It must be called with peersMu held.
+func (b *Bastion) notifyHandshakes(devicePeers []wgtypes.Peer, badPeers map[wgtypes.Key]struct{}) {
+	for _, dp := range devicePeers {
+		p, ok := b.peers[dp.PublicKey]
+		if !ok {
+			continue
+		}
+		if !p.handshaked && !dp.LastHandshakeTime.IsZero() {
+			p.handshaked = true
+			b.webhooks.Notify(p.webhookEvent(webhook.EventPeerHandshake, dp.PublicKey, ""))
+		}
+
+		_, bad := badPeers[dp.PublicKey]
+		// peers that never handshaked aren't stale, they just haven't connected yet
+		if bad && p.handshaked && !p.stale {
+			p.stale = true
+			b.webhooks.Notify(p.webhookEvent(webhook.EventPeerStale, dp.PublicKey, ""))
+		}
+		if !bad {
+			p.stale = false
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package tinybastion
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/acuteaura/tinybastion/internal/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBastion_Webhooks(t *testing.T) {
+	events := make(chan webhook.Event, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.True(t, webhook.Verify([]byte("secret"), body, r.Header.Get(webhook.SignatureHeader)))
+		var e webhook.Event
+		require.NoError(t, json.Unmarshal(body, &e))
+		events <- e
+	}))
+	defer receiver.Close()
+
+	b, device := newTestBastion(t, "10.0.0.0/29")
+	b.webhooks = webhook.New([]string{receiver.URL}, webhook.Options{Secret: "secret"})
+	defer b.webhooks.Close()
+
+	next := func() webhook.Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no webhook received")
+			return webhook.Event{}
+		}
+	}
+
+	key := generateKey(t)
+	_, err := b.AddPeer(context.Background(), key, PeerOptions{Owner: testIdentity, Claims: map[string]interface{}{"repository": "acuteaura/app"}})
+	require.NoError(t, err)
+	created := next()
+	assert.Equal(t, webhook.EventPeerCreated, created.Type)
+	assert.Equal(t, key.String(), created.PublicKey)
+	assert.Equal(t, []string{"10.0.0.2"}, created.IPs)
+	assert.Equal(t, "acuteaura/app", created.Repository)
+
+	require.NoError(t, device.SetLastHandshake(key, clock.Now()))
+	require.NoError(t, b.CleanupPeers())
+	assert.Equal(t, webhook.EventPeerHandshake, next().Type)
+
+	// only the first handshake is announced
+	require.NoError(t, b.CleanupPeers())
+
+	require.NoError(t, device.SetLastHandshake(key, clock.Now().Add(-time.Hour)))
+	require.NoError(t, b.CleanupPeers())
+	assert.Equal(t, webhook.EventPeerStale, next().Type)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.CleanupPeers())
+	}
+	removed := next()
+	assert.Equal(t, webhook.EventPeerRemoved, removed.Type)
+	assert.Equal(t, removedStale, removed.Reason)
+	assert.Empty(t, events)
+}